@@ -14,9 +14,13 @@ func main() {
 	handler.Startup(ctx)
 
 	defer func() {
-		cancel()
 		log.Println("Received termination signal")
-		handler.Teardown(ctx)
+
+		// drain and flush within the shutdown timeout, before cancelling the context the routes were started with
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), handler.ShutdownTimeout)
+		defer shutdownCancel()
+		handler.Teardown(shutdownCtx)
+		cancel()
 	}()
 
 	// set up process signal handling
@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/utils"
+)
+
+var (
+	// Bearer token required by the admin API, the API is disabled when empty
+	adminToken = utils.StringFromEnvWithDefault("ADMIN_TOKEN", "")
+)
+
+// registerAdminRoutes registers the admin API, unless ADMIN_TOKEN is empty
+func registerAdminRoutes(mux *http.ServeMux) {
+	if adminToken == "" {
+		return
+	}
+
+	admin := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, requireBearerToken(adminToken, handler))
+	}
+	admin("GET /admin/writers", handleListWriters)
+	admin("GET /admin/writers/{processorID}", handleGetWriter)
+	admin("POST /admin/writers/flush", handleFlushAllWriters)
+	admin("POST /admin/writers/{processorID}/flush", handleFlushWriter)
+	admin("DELETE /admin/writers/{processorID}", handleEvictWriter)
+	admin("GET /admin/processors/paused", handleListPaused)
+	admin("POST /admin/processors/{processorID}/pause", handlePauseProcessor)
+	admin("POST /admin/processors/{processorID}/resume", handleResumeProcessor)
+}
+
+// requireBearerToken rejects requests without the token as a bearer token in the Authorization header
+func requireBearerToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleListWriters(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, ListWriters())
+}
+
+func handleGetWriter(w http.ResponseWriter, r *http.Request) {
+	info, err := FindWriter(r.PathValue("processorID"))
+	if err != nil {
+		writeOperationError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func handleFlushAllWriters(w http.ResponseWriter, _ *http.Request) {
+	if err := FlushAllWriters(); err != nil {
+		writeOperationError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ListWriters())
+}
+
+func handleFlushWriter(w http.ResponseWriter, r *http.Request) {
+	processorID := r.PathValue("processorID")
+	if err := FlushWriter(processorID); err != nil {
+		writeOperationError(w, err)
+		return
+	}
+
+	info, err := FindWriter(processorID)
+	if err != nil {
+		writeOperationError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func handleEvictWriter(w http.ResponseWriter, r *http.Request) {
+	if err := EvictWriter(r.PathValue("processorID")); err != nil {
+		writeOperationError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleListPaused(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, PausedProcessors())
+}
+
+func handlePauseProcessor(w http.ResponseWriter, r *http.Request) {
+	PauseProcessor(r.PathValue("processorID"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleResumeProcessor(w http.ResponseWriter, r *http.Request) {
+	if !ResumeProcessor(r.PathValue("processorID")) {
+		writeJSONError(w, http.StatusNotFound, errors.New("processor is not paused"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeOperationError writes the error of an operation with the status matching its cause
+func writeOperationError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrWriterNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrInvalidQuery):
+		status = http.StatusBadRequest
+	case IsTransientError(err):
+		status = http.StatusServiceUnavailable
+	}
+	writeJSONError(w, status, err)
+}
+
+// writeJSONError writes the error as a json object
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeJSON writes the value as json with the status
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("error writing http response: %v\n", err)
+	}
+}
@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/repository/processor"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/utils"
+)
+
+// StatusDegraded is published for the routes whose records cannot be written while the database is unavailable
+const StatusDegraded processor.Status = "DEGRADED"
+
+var (
+	// Retries of a flush failing with a transient error, with exponential backoff and full jitter
+	dbRetryAttempts = utils.Int64FromEnvWithDefault("DB_RETRY_ATTEMPTS", 3)
+	dbRetryBase     = utils.DurationFromEnvWithDefault("DB_RETRY_BASE", 200*time.Millisecond)
+	dbRetryMax      = utils.DurationFromEnvWithDefault("DB_RETRY_MAX", 5*time.Second)
+
+	// Consecutive connection failures opening the circuit, and the interval at which the database is probed while open
+	dbBreaker = &circuitBreaker{
+		threshold: utils.Int64FromEnvWithDefault("BREAKER_THRESHOLD", 5),
+		cooldown:  utils.DurationFromEnvWithDefault("BREAKER_COOLDOWN", 15*time.Second),
+		routes:    make(map[string]bool),
+		ping:      pingDB,
+	}
+
+	// sleep waits between the attempts of a retried operation, replaced in tests
+	sleep = time.Sleep
+)
+
+var (
+	// Transient errors, the message is redelivered
+	ErrCircuitOpen = errors.New("database unavailable, circuit breaker is open")
+)
+
+// circuitBreaker is shared by every writer. It opens once consecutive database writes fail to reach the database,
+// failing writes fast while open, and closes once a probe reaches the database again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	open      bool
+	failures  int64           // consecutive connection failures
+	threshold int64           // connection failures opening the circuit
+	cooldown  time.Duration   // interval between probes while open
+	routes    map[string]bool // routes held back while open, a degraded status is published for each
+	ping      func() error    // checks that the database is reachable again while open
+}
+
+// Open reports whether the circuit is open, i.e. the database is considered unavailable
+func (b *circuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// allow returns ErrCircuitOpen while the circuit is open
+func (b *circuitBreaker) allow() error {
+	if b.Open() {
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// record accounts for the outcome of a database write, opening the circuit once the threshold of consecutive
+// connection failures is reached
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil || !isConnectionError(err) {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.open || b.failures < b.threshold {
+		return
+	}
+
+	log.Printf("database unavailable after %d consecutive failures, opening circuit: %v\n", b.failures, err)
+	b.open = true
+	go b.probe()
+}
+
+// degrade records a route held back while the circuit is open, publishing its degraded status the first time
+func (b *circuitBreaker) degrade(routeID string) {
+	b.mu.Lock()
+	if !b.open || b.routes[routeID] {
+		b.mu.Unlock()
+		return
+	}
+	b.routes[routeID] = true
+	b.mu.Unlock()
+
+	PublishRouteStatus(context.Background(), routeID, StatusDegraded, ErrCircuitOpen.Error(), nil)
+}
+
+// probe pings the database every cooldown until it is reachable, republishing the degraded status of the held back
+// routes after each failed probe, and then closes the circuit
+func (b *circuitBreaker) probe() {
+	ticker := time.NewTicker(b.cooldown)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := b.ping()
+		if err == nil {
+			break
+		}
+
+		log.Printf("database still unavailable: %v\n", err)
+		b.mu.Lock()
+		routes := make([]string, 0, len(b.routes))
+		for routeID := range b.routes {
+			routes = append(routes, routeID)
+		}
+		b.mu.Unlock()
+
+		for _, routeID := range routes {
+			PublishRouteStatus(context.Background(), routeID, StatusDegraded, err.Error(), nil)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	log.Printf("database available again, closing circuit\n")
+	b.open = false
+	b.failures = 0
+	b.routes = make(map[string]bool)
+}
+
+// pingDB checks that the database is reachable
+func pingDB() error {
+	db, err := GetDB()
+	if err != nil {
+		return err
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return sqlDB.PingContext(ctx)
+}
+
+// withRetry runs the database operation, retrying transient failures with exponential backoff and full jitter up to
+// DB_RETRY_ATTEMPTS attempts, and failing fast with ErrCircuitOpen while the circuit is open
+func withRetry(operation func() error) error {
+	return dbBreaker.retry(operation)
+}
+
+// retry runs the operation under the circuit breaker, see withRetry
+func (b *circuitBreaker) retry(operation func() error) error {
+	for attempt := int64(1); ; attempt++ {
+		if err := b.allow(); err != nil {
+			return err
+		}
+
+		err := operation()
+		b.record(err)
+		if err == nil || !IsTransientError(err) || attempt >= dbRetryAttempts {
+			return err
+		}
+
+		delay := retryDelay(attempt)
+		log.Printf("retrying database write in %v after attempt %d failed: %v\n", delay, attempt, err)
+		sleep(delay)
+	}
+}
+
+// retryDelay returns a random delay up to the exponential backoff of the attempt, bounded by DB_RETRY_MAX
+func retryDelay(attempt int64) time.Duration {
+	ceiling := dbRetryMax
+	if attempt <= 32 {
+		ceiling = min(dbRetryBase<<(attempt-1), dbRetryMax)
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling)
+}
@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
+)
+
+// testBreaker returns a circuit breaker opening after two connection failures, whose probes fail the given number
+// of times before reaching the database
+func testBreaker(t *testing.T, failedProbes int32) (*circuitBreaker, *atomic.Int32) {
+	t.Helper()
+
+	probes := &atomic.Int32{}
+	b := &circuitBreaker{
+		threshold: 2,
+		cooldown:  time.Millisecond,
+		routes:    make(map[string]bool),
+		ping: func() error {
+			if probes.Add(1) <= failedProbes {
+				return errUnreachable
+			}
+			return nil
+		},
+	}
+	t.Cleanup(func() { waitClosed(t, b) })
+	return b, probes
+}
+
+var errUnreachable = &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+// waitClosed waits for the probe of an open circuit breaker to close it
+func waitClosed(t *testing.T, b *circuitBreaker) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); b.Open(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("circuit breaker did not close")
+		}
+	}
+}
+
+func TestCircuitBreakerOpensOnConsecutiveConnectionFailures(t *testing.T) {
+	b, probes := testBreaker(t, 2)
+	routeID := uuid.NewString()
+
+	// probing starts once the route is held back
+	held, ping := make(chan struct{}), b.ping
+	b.ping = func() error {
+		<-held
+		return ping()
+	}
+
+	for i, step := range []struct {
+		err  error
+		open bool
+	}{
+		{errUnreachable, false},
+		{&pgconn.PgError{Code: "23505"}, false}, // a refused statement reached the database, resetting the failures
+		{errUnreachable, false},
+		{nil, false},
+		{errUnreachable, false},
+		{errUnreachable, true},
+	} {
+		b.record(step.err)
+		if b.Open() != step.open {
+			t.Fatalf("step %d: circuit open = %v, want %v", i, b.Open(), step.open)
+		}
+	}
+
+	// an open circuit fails fast and holds the route back, publishing its degraded status once until it closes
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("allow on an open circuit returned %v, want ErrCircuitOpen", err)
+	}
+	b.degrade(routeID)
+	b.degrade(routeID)
+	close(held)
+
+	// the probe closes the circuit once it reaches the database
+	waitClosed(t, b)
+	if n := probes.Load(); n != 3 {
+		t.Errorf("probed the database %d times, want 3", n)
+	}
+	if err := b.allow(); err != nil {
+		t.Errorf("allow on a closed circuit returned %v", err)
+	}
+
+	// degraded once when held back and again after each failed probe
+	degraded := testMonitor.published(func(m models.MonitorMessage) bool {
+		return m.RouteID == routeID && m.Status == StatusDegraded
+	})
+	if len(degraded) != 3 {
+		t.Errorf("published %d degraded statuses, want 3", len(degraded))
+	}
+	if b.failures != 0 || len(b.routes) != 0 {
+		t.Errorf("closed circuit kept %d failures and %d routes, want none", b.failures, len(b.routes))
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var sleeps int
+	sleep = func(time.Duration) { sleeps++ }
+	t.Cleanup(func() { sleep = time.Sleep })
+
+	serialization := &pgconn.PgError{Code: "40001"}
+	refused := &pgconn.PgError{Code: "23505"}
+	for _, test := range []struct {
+		name     string
+		open     bool
+		errs     []error // returned by each attempt, nil once exhausted
+		want     error
+		attempts int
+		sleeps   int
+	}{
+		{name: "success", attempts: 1},
+		{name: "transient then success", errs: []error{serialization}, attempts: 2, sleeps: 1},
+		{name: "terminal", errs: []error{refused}, want: refused, attempts: 1},
+		{name: "transient until the attempts run out", errs: []error{serialization, serialization, serialization}, want: serialization, attempts: 3, sleeps: 2},
+		{name: "open circuit", open: true, want: ErrCircuitOpen},
+		{name: "connection failures opening the circuit", errs: []error{errUnreachable, errUnreachable}, want: ErrCircuitOpen, attempts: 2, sleeps: 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			b, _ := testBreaker(t, 0)
+			if test.open {
+				b.open = true
+				t.Cleanup(func() { b.open = false })
+			}
+			sleeps = 0
+
+			attempts := 0
+			err := b.retry(func() error {
+				attempts++
+				if attempts <= len(test.errs) {
+					return test.errs[attempts-1]
+				}
+				return nil
+			})
+
+			if !errors.Is(err, test.want) {
+				t.Errorf("retry returned %v, want %v", err, test.want)
+			}
+			if attempts != test.attempts {
+				t.Errorf("ran %d attempts, want %d", attempts, test.attempts)
+			}
+			if sleeps != test.sleeps {
+				t.Errorf("slept %d times between attempts, want %d", sleeps, test.sleeps)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempt := int64(1); attempt <= 40; attempt++ {
+		ceiling := dbRetryMax
+		if attempt <= 32 {
+			ceiling = min(dbRetryBase<<(attempt-1), dbRetryMax)
+		}
+		for range 100 {
+			if delay := retryDelay(attempt); delay < 0 || delay >= ceiling {
+				t.Fatalf("retryDelay(%d) = %v, want within [0, %v)", attempt, delay, ceiling)
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/utils"
+)
+
+const (
+	BackpressureBlock = "block" // hold the callback until the buffer has room, up to BACKPRESSURE_BLOCK_TIMEOUT (default)
+	BackpressureNak   = "nak"   // negatively acknowledge the message for redelivery with backoff
+	BackpressureSpill = "spill" // spill the records to local disk and acknowledge the message
+)
+
+var (
+	// Limits on the records buffered by a single writer, overridable per processor
+	writerMaxRecords = utils.Int64FromEnvWithDefault("WRITER_MAX_RECORDS", 10000)
+	writerMaxBytes   = utils.Int64FromEnvWithDefault("WRITER_MAX_BYTES", 64<<20)
+
+	// How long a callback is held by the block policy before its message is negatively acknowledged, below the
+	// shutdown timeout such that blocked callbacks do not hold up the shutdown
+	backpressureBlockTimeout = utils.DurationFromEnvWithDefault("BACKPRESSURE_BLOCK_TIMEOUT", 10*time.Second)
+
+	// Limits on the records buffered across every writer
+	globalBuffer = newBufferLimiter(
+		utils.Int64FromEnvWithDefault("MAX_BUFFERED_RECORDS", 100000),
+		utils.Int64FromEnvWithDefault("MAX_BUFFERED_BYTES", 512<<20),
+	)
+)
+
+var (
+	// Transient errors, the message is redelivered
+	ErrBufferFull = errors.New("batch buffer is full")
+)
+
+// BufferStats is a snapshot of the records buffered in memory by a writer, or across every writer
+type BufferStats struct {
+	ProcessorID  string `json:"processor_id,omitempty"`
+	Table        string `json:"table,omitempty"`
+	Records      int64  `json:"records"`
+	Bytes        int64  `json:"bytes"`
+	Messages     int64  `json:"messages"`
+	MaxRecords   int64  `json:"max_records"`
+	MaxBytes     int64  `json:"max_bytes"`
+	SpooledBytes int64  `json:"spooled_bytes"` // records spooled to disk and not yet written to the table
+}
+
+// bufferLimiter accounts for the records buffered across every writer, waiters are woken whenever room is released
+type bufferLimiter struct {
+	mu         sync.Mutex
+	records    int64
+	bytes      int64
+	maxRecords int64
+	maxBytes   int64
+	released   chan struct{} // closed and replaced whenever room is released
+}
+
+// newBufferLimiter creates a limiter with the given limits, a limit of zero or less is unbounded
+func newBufferLimiter(maxRecords int64, maxBytes int64) *bufferLimiter {
+	return &bufferLimiter{maxRecords: maxRecords, maxBytes: maxBytes, released: make(chan struct{})}
+}
+
+// tryReserve reserves room for the records when they fit within the limits. A reservation is always granted when
+// nothing is buffered, such that a single message larger than the limits still makes progress.
+func (l *bufferLimiter) tryReserve(records int64, bytes int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !withinLimits(l.records, l.bytes, records, bytes, l.maxRecords, l.maxBytes) {
+		return false
+	}
+	l.records += records
+	l.bytes += bytes
+	return true
+}
+
+// release returns the room reserved for the records, waking any waiters
+func (l *bufferLimiter) release(records int64, bytes int64) {
+	if records == 0 && bytes == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records -= records
+	l.bytes -= bytes
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// waitRelease returns a channel closed the next time room is released
+func (l *bufferLimiter) waitRelease() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.released
+}
+
+// stats returns a snapshot of the records buffered across every writer
+func (l *bufferLimiter) stats() BufferStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return BufferStats{Records: l.records, Bytes: l.bytes, MaxRecords: l.maxRecords, MaxBytes: l.maxBytes}
+}
+
+// withinLimits reports whether adding to the buffered records stays within the limits, an empty buffer accepts
+// anything
+func withinLimits(records, bytes, addRecords, addBytes, maxRecords, maxBytes int64) bool {
+	if records == 0 && bytes == 0 {
+		return true
+	}
+	if maxRecords > 0 && records+addRecords > maxRecords {
+		return false
+	}
+	if maxBytes > 0 && bytes+addBytes > maxBytes {
+		return false
+	}
+	return true
+}
+
+// GlobalBufferStats returns a snapshot of the records buffered across every writer
+func GlobalBufferStats() BufferStats {
+	return globalBuffer.stats()
+}
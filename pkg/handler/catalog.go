@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// catalogReady records whether the catalog tables exist, a failed attempt is retried on the next use
+var (
+	catalogMu    sync.Mutex
+	catalogReady bool
+)
+
+// StateTable records the processor owning a table, such that two processors resolving to the same table name are
+// detected rather than writing into each other's table
+type StateTable struct {
+	Table       string    `gorm:"column:table_name;type:text;primaryKey"`
+	ProcessorID string    `gorm:"column:processor_id;type:varchar(36);not null;index"`
+	ProjectID   string    `gorm:"column:project_id;type:varchar(36)"`
+	CreatedAt   time.Time `gorm:"column:created_at;not null;autoCreateTime"`
+}
+
+// TableName overrides the table name used by GORM
+func (StateTable) TableName() string {
+	return "state_tables_catalog"
+}
+
+// StateTableColumn maps a record key onto the column holding its values, such that readers can reverse the
+// normalization of column names
+type StateTableColumn struct {
+	Table      string    `gorm:"column:table_name;type:text;primaryKey;uniqueIndex:idx_state_tables_columns_column,priority:1"`
+	SourceKey  string    `gorm:"column:source_key;type:text;primaryKey"`
+	ColumnName string    `gorm:"column:column_name;type:varchar(63);not null;uniqueIndex:idx_state_tables_columns_column,priority:2"`
+	CreatedAt  time.Time `gorm:"column:created_at;not null;autoCreateTime"`
+}
+
+// TableName overrides the table name used by GORM
+func (StateTableColumn) TableName() string {
+	return "state_tables_columns"
+}
+
+// EnsureCatalog creates the catalog tables on first use, retrying on later calls until it succeeds such that a
+// database unavailable at startup does not disable the catalog
+func EnsureCatalog() error {
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+
+	if catalogReady {
+		return nil
+	}
+
+	db, err := GetDB()
+	if err != nil {
+		return err
+	}
+	if err = db.AutoMigrate(&StateTable{}, &StateTableColumn{}); err != nil {
+		return err
+	}
+	catalogReady = true
+	return nil
+}
+
+// RegisterTable records the processor owning a table, failing with ErrInvalidConfig when the table is owned by
+// another processor
+func RegisterTable(tableName string, processorID string, projectID string) error {
+	if err := EnsureCatalog(); err != nil {
+		return err
+	}
+
+	db, err := GetDB()
+	if err != nil {
+		return err
+	}
+
+	table := StateTable{Table: tableName, ProcessorID: processorID, ProjectID: projectID}
+	if err = db.Clauses(clause.OnConflict{DoNothing: true}).Create(&table).Error; err != nil {
+		return fmt.Errorf("failed to register table %s: %w", tableName, err)
+	}
+
+	var registered StateTable
+	if err = db.Where("table_name = ?", tableName).Take(&registered).Error; err != nil {
+		return fmt.Errorf("failed to read owner of table %s: %w", tableName, err)
+	}
+	if registered.ProcessorID != processorID {
+		return fmt.Errorf("%w: table name %s is already used by processor %s", ErrInvalidConfig, tableName, registered.ProcessorID)
+	}
+	return nil
+}
+
+// FindColumnMappings returns the column name of each record key known to a table
+func FindColumnMappings(tableName string) (map[string]string, error) {
+	if err := EnsureCatalog(); err != nil {
+		return nil, err
+	}
+
+	db, err := GetDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []StateTableColumn
+	if err = db.Where("table_name = ?", tableName).Find(&columns).Error; err != nil {
+		return nil, err
+	}
+
+	mappings := make(map[string]string, len(columns))
+	for _, column := range columns {
+		mappings[column.SourceKey] = column.ColumnName
+	}
+	return mappings, nil
+}
+
+// DeleteColumnMappings forgets the column names of a table, e.g. once it is dropped
+func DeleteColumnMappings(tableName string) error {
+	if err := EnsureCatalog(); err != nil {
+		return err
+	}
+
+	db, err := GetDB()
+	if err != nil {
+		return err
+	}
+	return db.Where("table_name = ?", tableName).Delete(&StateTableColumn{}).Error
+}
+
+// RegisterColumnMapping records the column name of a record key, returning the column actually registered for the
+// key (another instance may have registered it first), or an empty name when the column is taken by another key
+func RegisterColumnMapping(tableName string, sourceKey string, columnName string) (string, error) {
+	if err := EnsureCatalog(); err != nil {
+		return "", err
+	}
+
+	db, err := GetDB()
+	if err != nil {
+		return "", err
+	}
+
+	mapping := StateTableColumn{Table: tableName, SourceKey: sourceKey, ColumnName: columnName}
+	if err = db.Clauses(clause.OnConflict{DoNothing: true}).Create(&mapping).Error; err != nil {
+		return "", fmt.Errorf("failed to register column %s for key %s: %w", columnName, sourceKey, err)
+	}
+
+	var registered StateTableColumn
+	err = db.Where("table_name = ? AND source_key = ?", tableName, sourceKey).Take(&registered).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+	return registered.ColumnName, nil
+}
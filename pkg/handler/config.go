@@ -3,30 +3,378 @@ package handler
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"sync"
+	"time"
+
 	"github.com/quantumwake/alethic-ism-core-go/pkg/data"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/repository/processor"
 	"github.com/quantumwake/alethic-ism-core-go/pkg/repository/processor/tables"
 )
 
-// getProcessorConfig fetches and parses the table processor configuration from processor properties
-func getProcessorConfig(processorID string) (*tables.TableProcessorConfig, error) {
+const (
+	WriteModeAppend       = "append"        // every record is inserted as a new row (default)
+	WriteModeUpsert       = "upsert"        // a record replaces the row with the same key columns
+	WriteModeInsertIgnore = "insert-ignore" // a record whose key columns already exist is dropped
+	WriteModeHistory      = "history"       // a record closes the current version of its key and becomes the new one
+)
+
+// minBatchWindowTTL is the shortest batch window, in seconds, honored by the background flush
+const minBatchWindowTTL = 5
+
+const (
+	SchemaPolicyCoerce = "coerce" // drop undeclared keys and convert values where possible (default)
+	SchemaPolicyReject = "reject" // reject any record that does not exactly conform to the declared columns
+)
+
+// TableConfig is the table processor configuration extended with the properties specific to this service
+type TableConfig struct {
+	tables.TableProcessorConfig
+
+	Columns        []ColumnDefinition `json:"columns,omitempty"`        // Explicit table schema, inferred from the records when empty
+	SchemaPolicy   *string            `json:"schemaPolicy,omitempty"`   // How records not conforming to the declared columns are handled
+	WriteMode      *string            `json:"writeMode,omitempty"`      // How records are written, see the WriteMode constants
+	KeyColumns     []string           `json:"keyColumns,omitempty"`     // Columns identifying a record, defaults to the declared primary key
+	TrackedColumns []string           `json:"trackedColumns,omitempty"` // Columns whose changes produce a new version in history mode, defaults to all
+	ColumnNaming   *string            `json:"columnNaming,omitempty"`   // How record keys map to column names, see the ColumnNaming constants
+
+	TableNameTemplate *string `json:"tableNameTemplate,omitempty"` // Table name with {project}, {processor}, {processor_short} and {name} placeholders
+
+	MaxBufferedRecords *int64  `json:"maxBufferedRecords,omitempty"` // Records buffered before backpressure applies, defaults to WRITER_MAX_RECORDS
+	MaxBufferedBytes   *int64  `json:"maxBufferedBytes,omitempty"`   // Approximate bytes buffered before backpressure applies, defaults to WRITER_MAX_BYTES
+	Backpressure       *string `json:"backpressure,omitempty"`       // What happens to records when the buffer is full, see the Backpressure constants
+
+	Forward *ForwardConfig `json:"forward,omitempty"` // Where the written records are published, nowhere when empty
+
+	ProcessorID string `json:"-"` // Processor the configuration belongs to
+	ProjectID   string `json:"-"` // Project of the processor
+	tableName   string // resolved from the table name template when the configuration is fetched
+	version     string // hash of the configuration, to detect changes to the processor properties
+}
+
+// ColumnDefinition declares a column of a state table, named by its record key
+type ColumnDefinition struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Nullable   *bool  `json:"nullable,omitempty"` // Defaults to true
+	Default    any    `json:"default,omitempty"`  // Literal value, or one of the supported default expressions (e.g. now())
+	PrimaryKey bool   `json:"primaryKey,omitempty"`
+
+	columnType ColumnType // parsed from Type when the configuration is validated
+}
+
+// DefaultTableConfig returns the default configuration
+func DefaultTableConfig() *TableConfig {
+	policy := SchemaPolicyCoerce
+	mode := WriteModeAppend
+	naming := ColumnNamingPreserve
+	return &TableConfig{
+		TableProcessorConfig: *tables.DefaultTableProcessorConfig(),
+		SchemaPolicy:         &policy,
+		WriteMode:            &mode,
+		ColumnNaming:         &naming,
+	}
+}
+
+// IsNullable reports whether the column accepts null values
+func (c *ColumnDefinition) IsNullable() bool {
+	return !c.PrimaryKey && (c.Nullable == nil || *c.Nullable)
+}
+
+// ColumnType returns the parsed postgres type of the column
+func (c *ColumnDefinition) ColumnType() ColumnType {
+	return c.columnType
+}
+
+// Naming returns the column naming mode
+func (c *TableConfig) Naming() string {
+	if c.ColumnNaming == nil {
+		return ColumnNamingPreserve
+	}
+	return *c.ColumnNaming
+}
+
+// Version returns a hash identifying the configuration, it changes whenever the processor properties change
+func (c *TableConfig) Version() string {
+	return c.version
+}
+
+// FlushWindow returns the interval at which batches are flushed regardless of their size, and whether time based
+// flushing is enabled (windows shorter than minBatchWindowTTL seconds are ignored)
+func (c *TableConfig) FlushWindow() (time.Duration, bool) {
+	if c.BatchWindowTTL == nil || *c.BatchWindowTTL < minBatchWindowTTL {
+		return 0, false
+	}
+	return time.Duration(*c.BatchWindowTTL) * time.Second, true
+}
+
+// BufferLimits returns the maximum number of records and approximate bytes buffered by the writer
+func (c *TableConfig) BufferLimits() (int64, int64) {
+	maxRecords, maxBytes := writerMaxRecords, writerMaxBytes
+	if c.MaxBufferedRecords != nil {
+		maxRecords = *c.MaxBufferedRecords
+	}
+	if c.MaxBufferedBytes != nil {
+		maxBytes = *c.MaxBufferedBytes
+	}
+	return maxRecords, maxBytes
+}
+
+// BackpressurePolicy returns what happens to records when the buffer is full
+func (c *TableConfig) BackpressurePolicy() string {
+	if c.Backpressure == nil {
+		return BackpressureBlock
+	}
+	return *c.Backpressure
+}
+
+// Table returns the resolved table name
+func (c *TableConfig) Table() string {
+	return c.tableName
+}
+
+// resolveTableName renders the table name template for the processor the configuration belongs to
+func (c *TableConfig) resolveTableName() error {
+	template := DefaultTableNameTemplate
+	if c.TableNameTemplate != nil {
+		template = *c.TableNameTemplate
+	}
+
+	name := ""
+	if c.TableName != nil {
+		name = *c.TableName
+	}
+
+	tableName, err := FormatTableName(template, c.ProjectID, c.ProcessorID, name)
+	if err != nil {
+		return err
+	}
+	c.tableName = tableName
+	return nil
+}
+
+// HasSchema reports whether the table columns are declared rather than inferred
+func (c *TableConfig) HasSchema() bool {
+	return len(c.Columns) > 0
+}
+
+// IncludesTimestamp reports whether a _timestamp column is added to each record
+func (c *TableConfig) IncludesTimestamp() bool {
+	return (c.IncludeTimestamp != nil && *c.IncludeTimestamp) || (c.Forward != nil && c.Forward.Timestamp)
+}
+
+// IncludesRowID reports whether a generated _row_id column is added to each record
+func (c *TableConfig) IncludesRowID() bool {
+	return c.Forward != nil && c.Forward.RowID
+}
+
+// Mode returns the write mode
+func (c *TableConfig) Mode() string {
+	if c.WriteMode == nil {
+		return WriteModeAppend
+	}
+	return *c.WriteMode
+}
+
+// Keys returns the columns identifying a record, the configured key columns or else the declared primary key
+func (c *TableConfig) Keys() []string {
+	if len(c.KeyColumns) > 0 {
+		return c.KeyColumns
+	}
+
+	var keys []string
+	for _, column := range c.Columns {
+		if column.PrimaryKey {
+			keys = append(keys, column.Name)
+		}
+	}
+	return keys
+}
+
+// ColumnKeys returns the record keys named by the configuration, declared columns, key and tracked columns
+func (c *TableConfig) ColumnKeys() []string {
+	var keys []string
+	for _, column := range c.ColumnDefinitions() {
+		keys = append(keys, column.Name)
+	}
+	keys = append(keys, c.KeyColumns...)
+	return append(keys, c.TrackedColumns...)
+}
+
+// ColumnDefinitions returns the declared columns, including the implicit _timestamp and _row_id columns when enabled
+func (c *TableConfig) ColumnDefinitions() []ColumnDefinition {
+	columns := append([]ColumnDefinition{}, c.Columns...)
+	if c.IncludesTimestamp() {
+		columns = withImplicitColumn(columns, "_timestamp", ColumnTimestamp)
+	}
+	if c.IncludesRowID() {
+		columns = withImplicitColumn(columns, "_row_id", ColumnUUID)
+	}
+	return columns
+}
+
+// withImplicitColumn appends the implicit column unless it is declared
+func withImplicitColumn(columns []ColumnDefinition, name string, columnType ColumnType) []ColumnDefinition {
+	for _, column := range columns {
+		if column.Name == name {
+			return columns
+		}
+	}
+	return append(columns, ColumnDefinition{Name: name, Type: string(columnType), columnType: columnType})
+}
+
+// validate checks the declared columns and policies, resolving the column types
+func (c *TableConfig) validate() error {
+	if c.SchemaPolicy != nil && *c.SchemaPolicy != SchemaPolicyCoerce && *c.SchemaPolicy != SchemaPolicyReject {
+		return fmt.Errorf("unknown schema policy %q", *c.SchemaPolicy)
+	}
+
+	switch c.Naming() {
+	case ColumnNamingPreserve, ColumnNamingSnakeCase, ColumnNamingLower:
+	default:
+		return fmt.Errorf("unknown column naming %q", c.Naming())
+	}
+
+	switch c.BackpressurePolicy() {
+	case BackpressureBlock, BackpressureNak, BackpressureSpill:
+	default:
+		return fmt.Errorf("unknown backpressure policy %q", c.BackpressurePolicy())
+	}
+
+	switch c.Mode() {
+	case WriteModeAppend, WriteModeInsertIgnore:
+	case WriteModeUpsert:
+		if len(c.Keys()) == 0 {
+			return fmt.Errorf("write mode %q requires keyColumns or a declared primary key", c.Mode())
+		}
+	case WriteModeHistory:
+		// a key has many versions, so it cannot be the primary key
+		if len(c.KeyColumns) == 0 {
+			return fmt.Errorf("write mode %q requires keyColumns", c.Mode())
+		}
+		for _, column := range c.Columns {
+			if column.PrimaryKey {
+				return fmt.Errorf("write mode %q does not support a declared primary key", c.Mode())
+			}
+		}
+	default:
+		return fmt.Errorf("unknown write mode %q", c.Mode())
+	}
+
+	seen := make(map[string]bool)
+	for i := range c.Columns {
+		column := &c.Columns[i]
+		if column.Name == "" {
+			return fmt.Errorf("column %d has no name", i)
+		}
+		if seen[column.Name] {
+			return fmt.Errorf("column %q is declared more than once", column.Name)
+		}
+		seen[column.Name] = true
+
+		columnType, err := ParseColumnType(column.Type)
+		if err != nil {
+			return fmt.Errorf("column %q: %v", column.Name, err)
+		}
+		column.columnType = columnType
+
+		if column.Default != nil {
+			if _, err = DefaultExpression(column.Default); err != nil {
+				return fmt.Errorf("column %q: %v", column.Name, err)
+			}
+		}
+	}
+
+	for _, key := range c.KeyColumns {
+		if key == "" {
+			return fmt.Errorf("key columns must not be empty")
+		}
+		if c.HasSchema() && !seen[key] {
+			return fmt.Errorf("key column %q is not a declared column", key)
+		}
+	}
+	return nil
+}
+
+var (
+	// Lookups of routes and processors, replaced in tests to run without a database
+	findRouteByID = func(routeID string) (*processor.State, error) {
+		return routeBackend.FindRouteByID(routeID)
+	}
+	findProcessorByID = func(processorID string) (*processor.Processor, error) {
+		return processorBackend.FindProcessorByID(processorID)
+	}
+
+	// The last route and processor configuration found, served while the database is unreachable such that messages
+	// keep being spooled throughout an outage once the cached lookups have expired
+	knownMu      sync.RWMutex
+	knownRoutes  = make(map[string]*processor.State)
+	knownConfigs = make(map[string]*TableConfig)
+)
+
+// lookupKnown runs a lookup and remembers its result. The last result found for the id is served instead when the
+// database is unreachable: without querying it while the circuit is open, or when the lookup fails to reach it.
+func lookupKnown[T any](kind string, known map[string]T, id string, lookup func(string) (T, error)) (T, error) {
+	knownMu.RLock()
+	last, exists := known[id]
+	knownMu.RUnlock()
+	if exists && dbBreaker.Open() {
+		return last, nil
+	}
+
+	value, err := lookup(id)
+	if err != nil {
+		if exists && isConnectionError(err) {
+			log.Printf("serving the last known %s %s, the database is unreachable: %v\n", kind, id, err)
+			return last, nil
+		}
+		return value, err
+	}
+
+	knownMu.Lock()
+	known[id] = value
+	knownMu.Unlock()
+	return value, nil
+}
+
+// findRoute finds a route, or serves the last one found while the database is unreachable
+func findRoute(routeID string) (*processor.State, error) {
+	return lookupKnown("route", knownRoutes, routeID, findRouteByID)
+}
+
+// getProcessorConfig returns the table processor configuration of a processor, or serves the last one found while
+// the database is unreachable
+func getProcessorConfig(processorID string) (*TableConfig, error) {
+	return lookupKnown("config of processor", knownConfigs, processorID, fetchProcessorConfig)
+}
+
+// fetchProcessorConfig fetches and parses the table processor configuration from processor properties
+func fetchProcessorConfig(processorID string) (*TableConfig, error) {
 	// Fetch processor from database
-	proc, err := processorBackend.FindProcessorByID(processorID)
+	proc, err := findProcessorByID(processorID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch processor %s: %v", processorID, err)
+		return nil, fmt.Errorf("failed to fetch processor %s: %w", processorID, err)
 	}
 
 	// Parse configuration from properties
 	config, err := parseProperties(proc.Properties)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse table processor config: %v", err)
+		return nil, fmt.Errorf("%w: failed to parse table processor config: %v", ErrInvalidConfig, err)
+	}
+
+	config.ProcessorID = proc.ID
+	config.ProjectID = proc.ProjectID
+	if err = config.resolveTableName(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
 	}
+	config.version = hashValues(config)
 	return config, nil
 }
 
 // parseProperties extracts table processor configuration from processor properties using JSON unmarshaling
-func parseProperties(properties *data.JSON) (*tables.TableProcessorConfig, error) {
+func parseProperties(properties *data.JSON) (*TableConfig, error) {
 	// Start with default configuration
-	config := tables.DefaultTableProcessorConfig()
+	config := DefaultTableConfig()
 
 	if properties == nil || *properties == nil {
 		return config, nil
@@ -43,5 +391,9 @@ func parseProperties(properties *data.JSON) (*tables.TableProcessorConfig, error
 		return nil, fmt.Errorf("failed to unmarshal table processor config: %v", err)
 	}
 
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
 	return config, nil
 }
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/routing"
+	rnats "github.com/quantumwake/alethic-ism-core-go/pkg/routing/nats"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/utils"
+)
+
+const (
+	ControlFlush         = "flush"          // flush the pending batch of the processor
+	ControlTruncate      = "truncate"       // remove every row from the processor's table, confirmed by the table name and token
+	ControlDrop          = "drop"           // drop the processor's table and its quarantine table, confirmed by the table name and token
+	ControlRebuildSchema = "rebuild_schema" // reapply the processor configuration to its table
+	ControlExport        = "export"         // return the rows of the processor's table, up to limit
+	ControlQuery         = "query"          // return a page of the rows of the processor's table matching the query
+)
+
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrUnauthorized   = errors.New("unauthorized")
+)
+
+var (
+	// Token required by the destructive commands, truncate and drop, which are disabled when empty
+	controlToken = utils.StringFromEnvWithDefault("CONTROL_TOKEN", "")
+)
+
+// ControlRequest is a command received on the control route
+type ControlRequest struct {
+	Command     string `json:"command"`
+	ProcessorID string `json:"processor_id"`
+	Confirm     string `json:"confirm,omitempty"` // the table name, required by truncate and drop
+	Token       string `json:"token,omitempty"`   // CONTROL_TOKEN, required by truncate and drop
+	Limit       int    `json:"limit,omitempty"`   // rows returned by export, bounded by EXPORT_MAX_ROWS
+
+	Query *QueryRequest `json:"query,omitempty"` // required by query, its processor_id is the request's
+}
+
+// ControlResponse is the reply to a command received on the control route
+type ControlResponse struct {
+	OK          bool   `json:"ok"`
+	Command     string `json:"command"`
+	ProcessorID string `json:"processor_id,omitempty"`
+	Result      any    `json:"result,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// ControlCallback executes a command received on the control route and replies with its outcome. Commands are
+// request-reply, so the control route must be a core nats subject rather than a jetstream consumer.
+func ControlCallback(ctx context.Context, msg routing.MessageEnvelop) {
+	var request ControlRequest
+	raw, err := msg.MessageRaw()
+	if err == nil {
+		err = json.Unmarshal(raw, &request)
+	}
+
+	var result any
+	if err == nil {
+		log.Printf("executing control command %q for processor %s\n", request.Command, request.ProcessorID)
+		result, err = ExecuteControl(request)
+	}
+
+	response := ControlResponse{OK: err == nil, Command: request.Command, ProcessorID: request.ProcessorID, Result: result}
+	if err != nil {
+		log.Printf("error executing control command %q for processor %s: %v\n", request.Command, request.ProcessorID, err)
+		response.Error = err.Error()
+	}
+	reply(msg, response)
+}
+
+// ExecuteControl executes a command, returning its result
+func ExecuteControl(request ControlRequest) (any, error) {
+	if request.ProcessorID == "" {
+		return nil, fmt.Errorf("%w: processor_id is required", ErrInvalidMessage)
+	}
+
+	switch request.Command {
+	case ControlFlush:
+		// a processor without a cached writer has no pending batch
+		if err := FlushWriter(request.ProcessorID); err != nil && !errors.Is(err, ErrWriterNotFound) {
+			return nil, err
+		}
+		return nil, nil
+	case ControlTruncate:
+		if err := authorize(request.Token); err != nil {
+			return nil, err
+		}
+		return nil, TruncateProcessorTable(request.ProcessorID, request.Confirm)
+	case ControlDrop:
+		if err := authorize(request.Token); err != nil {
+			return nil, err
+		}
+		return nil, DropProcessorTable(request.ProcessorID, request.Confirm)
+	case ControlRebuildSchema:
+		return RebuildProcessorSchema(request.ProcessorID)
+	case ControlExport:
+		return ExportProcessorTable(request.ProcessorID, request.Limit)
+	case ControlQuery:
+		if request.Query == nil {
+			return nil, fmt.Errorf("%w: query is required", ErrInvalidQuery)
+		}
+		query := *request.Query
+		query.ProcessorID = request.ProcessorID
+		return QueryTable(query)
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownCommand, request.Command)
+}
+
+// authorize returns ErrUnauthorized unless destructive commands are enabled and the token is CONTROL_TOKEN
+func authorize(token string) error {
+	if controlToken == "" {
+		return fmt.Errorf("%w: destructive commands are disabled without CONTROL_TOKEN", ErrUnauthorized)
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(controlToken)) != 1 {
+		return fmt.Errorf("%w: invalid token", ErrUnauthorized)
+	}
+	return nil
+}
+
+// reply responds to a request received on a core nats subject, requests without a reply subject are logged
+func reply(msg routing.MessageEnvelop, value any) {
+	envelop, ok := msg.(*rnats.MessageEnvelop)
+	if !ok || envelop.Msg == nil || envelop.Msg.Reply == "" {
+		log.Printf("dropping reply to control message without a reply subject: %+v\n", value)
+		return
+	}
+
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("error marshalling control reply: %v\n", err)
+		return
+	}
+	if err = envelop.Msg.Respond(bytes); err != nil {
+		log.Printf("error replying to control message: %v\n", err)
+	}
+}
@@ -0,0 +1,25 @@
+package handler
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDestructiveCommandsRequireControlToken(t *testing.T) {
+	token := controlToken
+	t.Cleanup(func() { controlToken = token })
+
+	for _, command := range []string{ControlTruncate, ControlDrop} {
+		request := ControlRequest{Command: command, ProcessorID: "processor", Confirm: "table", Token: "secret"}
+
+		controlToken = ""
+		if _, err := ExecuteControl(request); !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("%s without CONTROL_TOKEN returned %v, want ErrUnauthorized", command, err)
+		}
+
+		controlToken = "other"
+		if _, err := ExecuteControl(request); !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("%s with an invalid token returned %v, want ErrUnauthorized", command, err)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package handler
 
 import (
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 
@@ -11,6 +14,12 @@ import (
 	"gorm.io/gorm/logger"
 )
 
+// maxQueryParameters is the postgres limit on bind parameters in a single statement
+const maxQueryParameters = 65535
+
+// quarantineSuffix is appended to a table name to name its quarantine table
+const quarantineSuffix = "_quarantine"
+
 var (
 	db   *gorm.DB
 	once sync.Once
@@ -31,66 +40,563 @@ func GetDB() (*gorm.DB, error) {
 	return db, err
 }
 
-// FormatTableName creates a valid table name from processor ID and optional config name
-func FormatTableName(processorID string, configName string) string {
-	//sanitized := strings.ReplaceAll(processorID, "-", "_")
-	if configName != "" {
-		return fmt.Sprintf("%s_%s", processorID, configName)
+// execSQL executes a statement on the connection or transaction, bypassing gorm's placeholder parsing such that
+// identifiers containing ? or @ reach postgres untouched, arguments are bound to $n placeholders
+func execSQL(tx *gorm.DB, query string, args ...interface{}) error {
+	_, err := execSQLRows(tx, query, args...)
+	return err
+}
+
+// execSQLRows executes a statement (see execSQL), returning the number of rows it affected
+func execSQLRows(tx *gorm.DB, query string, args ...interface{}) (int64, error) {
+	result, err := tx.Statement.ConnPool.ExecContext(tx.Statement.Context, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// execDDL executes a schema change (see execSQL), counting it in the metrics by operation
+func execDDL(tx *gorm.DB, operation string, query string) error {
+	err := execSQL(tx, query)
+	observeDDL(operation, err)
+	return err
+}
+
+// querySQL runs a query on the connection or transaction, bypassing gorm's placeholder parsing (see execSQL)
+func querySQL(tx *gorm.DB, query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Statement.ConnPool.QueryContext(tx.Statement.Context, query, args...)
+}
+
+// FormatTableName renders the table name template for a processor, e.g. {project}_{processor_short}_{name}. The
+// configured name may only contain letters, digits, underscores and hyphens, and a name exceeding the identifier limit
+// is truncated and suffixed with a hash of the full name.
+func FormatTableName(template string, projectID string, processorID string, configName string) (string, error) {
+	if !isTableNameSafe(configName) {
+		return "", fmt.Errorf("invalid table name %q: only letters, digits, '_' and '-' are allowed", configName)
+	}
+
+	// the template is split into literals and rendered placeholders
+	type part struct {
+		text        string
+		placeholder bool
+	}
+	var parts []part
+	for rest := template; rest != ""; {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			parts = append(parts, part{text: rest})
+			break
+		}
+		parts = append(parts, part{text: rest[:start]})
+
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("invalid table name template %q: unterminated placeholder", template)
+		}
+
+		var value string
+		switch placeholder := rest[start+1 : start+end]; placeholder {
+		case "project":
+			value = projectID
+		case "processor":
+			value = processorID
+		case "processor_short":
+			value = truncateBytes(strings.ReplaceAll(processorID, "-", ""), identifierHashLen)
+		case "name":
+			value = configName
+		default:
+			return "", fmt.Errorf("invalid table name template %q: unknown placeholder {%s}", template, placeholder)
+		}
+		parts = append(parts, part{text: value, placeholder: true})
+		rest = rest[start+end+1:]
+	}
+
+	// an empty placeholder must not leave a dangling separator, e.g. {processor}_{name} without a name: the separators
+	// of the literal preceding it are dropped, or else those of the literal following it. Separators that are part
+	// of a rendered value are kept.
+	for i, p := range parts {
+		if !p.placeholder || p.text != "" {
+			continue
+		}
+		switch {
+		case i > 0 && !parts[i-1].placeholder && parts[i-1].text != "":
+			parts[i-1].text = strings.TrimRight(parts[i-1].text, "_-")
+		case i+1 < len(parts) && !parts[i+1].placeholder:
+			parts[i+1].text = strings.TrimLeft(parts[i+1].text, "_-")
+		}
+	}
+
+	var b strings.Builder
+	for _, p := range parts {
+		b.WriteString(p.text)
+	}
+	tableName := b.String()
+	if tableName == "" {
+		return "", fmt.Errorf("invalid table name template %q: renders an empty table name", template)
 	}
-	return processorID
+	if !isTableNameSafe(tableName) {
+		return "", fmt.Errorf("invalid table name %q: only letters, digits, '_' and '-' are allowed", tableName)
+	}
+	return truncateTableName(tableName), nil
 }
 
-// CreateTableFromMap creates a table with TEXT columns based on the keys in the first record
-func CreateTableFromMap(tableName string, firstRecord models.Data) error {
+// CreateTableFromMap creates a table with a typed column for each of the given columns
+func CreateTableFromMap(tableName string, columnTypes map[string]ColumnType) error {
 	db, err := GetDB()
 	if err != nil {
 		return err
 	}
 
 	var columns []string
-	for key := range firstRecord {
+	for _, key := range sortedColumns(columnTypes) {
 		// Quote column names to handle special characters
-		columnDef := fmt.Sprintf(`"%s" TEXT`, key)
+		columnDef := fmt.Sprintf(`%s %s`, quoteIdent(key), columnTypes[key])
 		columns = append(columns, columnDef)
 	}
 
 	// Quote table name to handle names starting with numbers
 	createSQL := fmt.Sprintf(
-		`CREATE TABLE IF NOT EXISTS "%s" (%s)`,
-		tableName,
+		`CREATE TABLE IF NOT EXISTS %s (%s)`,
+		quoteIdent(tableName),
+		strings.Join(columns, ", "),
+	)
+
+	return execDDL(db, "create_table", createSQL)
+}
+
+// CreateTableFromDefinition creates a table from declared columns, with their nullability, defaults and primary key
+func CreateTableFromDefinition(tableName string, definitions []ColumnDefinition) error {
+	db, err := GetDB()
+	if err != nil {
+		return err
+	}
+
+	var columns []string
+	var primaryKey []string
+	for _, definition := range definitions {
+		columnDef, err := columnDefinitionSQL(definition, !definition.IsNullable())
+		if err != nil {
+			return err
+		}
+		columns = append(columns, columnDef)
+
+		if definition.PrimaryKey {
+			primaryKey = append(primaryKey, quoteIdent(definition.Name))
+		}
+	}
+
+	if len(primaryKey) > 0 {
+		columns = append(columns, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(primaryKey, ", ")))
+	}
+
+	createSQL := fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s (%s)`,
+		quoteIdent(tableName),
 		strings.Join(columns, ", "),
 	)
 
-	return db.Exec(createSQL).Error
+	return execDDL(db, "create_table", createSQL)
+}
+
+// AddColumnDefinitions adds declared columns to an existing table, a column is only made NOT NULL when it has a
+// default, since the table may already contain rows
+func AddColumnDefinitions(tableName string, definitions []ColumnDefinition) error {
+	if len(definitions) == 0 {
+		return nil
+	}
+
+	db, err := GetDB()
+	if err != nil {
+		return err
+	}
+
+	var clauses []string
+	for _, definition := range definitions {
+		columnDef, err := columnDefinitionSQL(definition, !definition.IsNullable() && definition.Default != nil)
+		if err != nil {
+			return err
+		}
+		clauses = append(clauses, "ADD COLUMN IF NOT EXISTS "+columnDef)
+	}
+
+	alterSQL := fmt.Sprintf(
+		`ALTER TABLE %s %s`,
+		quoteIdent(tableName),
+		strings.Join(clauses, ", "),
+	)
+
+	return execDDL(db, "add_columns", alterSQL)
+}
+
+// columnDefinitionSQL renders a declared column as a column definition
+func columnDefinitionSQL(definition ColumnDefinition, notNull bool) (string, error) {
+	columnDef := fmt.Sprintf(`%s %s`, quoteIdent(definition.Name), definition.ColumnType())
+	if notNull {
+		columnDef += " NOT NULL"
+	}
+
+	if definition.Default != nil {
+		expression, err := DefaultExpression(definition.Default)
+		if err != nil {
+			return "", fmt.Errorf("column %s: %w", definition.Name, err)
+		}
+		columnDef += " DEFAULT " + expression
+	}
+	return columnDef, nil
+}
+
+// AddColumns adds typed columns to an existing table, columns that already exist are left untouched
+func AddColumns(tableName string, columnTypes map[string]ColumnType) error {
+	if len(columnTypes) == 0 {
+		return nil
+	}
+
+	db, err := GetDB()
+	if err != nil {
+		return err
+	}
+
+	var clauses []string
+	for _, column := range sortedColumns(columnTypes) {
+		clauses = append(clauses, fmt.Sprintf(`ADD COLUMN IF NOT EXISTS %s %s`, quoteIdent(column), columnTypes[column]))
+	}
+
+	alterSQL := fmt.Sprintf(
+		`ALTER TABLE %s %s`,
+		quoteIdent(tableName),
+		strings.Join(clauses, ", "),
+	)
+
+	return execDDL(db, "add_columns", alterSQL)
+}
+
+// AlterColumnTypes changes the type of existing columns, converting the existing values to the new type
+func AlterColumnTypes(tableName string, columnTypes map[string]ColumnType) error {
+	if len(columnTypes) == 0 {
+		return nil
+	}
+
+	db, err := GetDB()
+	if err != nil {
+		return err
+	}
+
+	var clauses []string
+	for _, column := range sortedColumns(columnTypes) {
+		columnType := columnTypes[column]
+		clauses = append(clauses, fmt.Sprintf(`ALTER COLUMN %s TYPE %s USING %s`, quoteIdent(column), columnType, convertExpression(column, columnType)))
+	}
+
+	alterSQL := fmt.Sprintf(
+		`ALTER TABLE %s %s`,
+		quoteIdent(tableName),
+		strings.Join(clauses, ", "),
+	)
+
+	return execDDL(db, "alter_column_types", alterSQL)
+}
+
+// convertExpression returns the expression converting the values of a column to the given type. Postgres has no cast
+// from scalar types to jsonb, so scalars are converted with to_jsonb (e.g. 42 becomes the json number 42).
+func convertExpression(column string, columnType ColumnType) string {
+	if columnType == ColumnJSONB {
+		return fmt.Sprintf(`to_jsonb(%s)`, quoteIdent(column))
+	}
+	return fmt.Sprintf(`%s::%s`, quoteIdent(column), columnType)
+}
+
+// FindTableColumns returns the columns of a table in the current schema with their types, an empty set if the
+// table does not exist
+func FindTableColumns(tableName string) (map[string]ColumnType, error) {
+	db, err := GetDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		ColumnName string
+		DataType   string
+	}
+	err = db.Raw(
+		`SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ?`,
+		tableName,
+	).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]ColumnType, len(rows))
+	for _, row := range rows {
+		columns[row.ColumnName] = ColumnTypeFromDataType(row.DataType)
+	}
+	return columns, nil
+}
+
+// TruncateTable removes every row from a table
+func TruncateTable(tableName string) error {
+	db, err := GetDB()
+	if err != nil {
+		return err
+	}
+	return execDDL(db, "truncate_table", fmt.Sprintf(`TRUNCATE TABLE %s`, quoteIdent(tableName)))
 }
 
-// InsertRecord inserts a single record into the specified table
-func InsertRecord(tableName string, record models.Data) error {
+// DropTable drops a table if it exists
+func DropTable(tableName string) error {
 	db, err := GetDB()
 	if err != nil {
 		return err
 	}
+	return execDDL(db, "drop_table", fmt.Sprintf(`DROP TABLE IF EXISTS %s`, quoteIdent(tableName)))
+}
+
+// SelectRows returns up to limit rows of a table in their physical order, keyed by column name
+func SelectRows(tableName string, limit int) ([]models.Data, error) {
+	db, err := GetDB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := querySQL(db, fmt.Sprintf(`SELECT * FROM %s ORDER BY ctid LIMIT $1`, quoteIdent(tableName)), limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanRows(rows)
+}
+
+// scanRows reads every row keyed by column name and closes the rows, text and json values returned as bytes are
+// returned as strings
+func scanRows(rows *sql.Rows) ([]models.Data, error) {
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]models.Data, 0)
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		row := make(models.Data, len(columns))
+		for i, column := range columns {
+			if bytes, ok := values[i].([]byte); ok {
+				row[column] = string(bytes)
+			} else {
+				row[column] = values[i]
+			}
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// sortedColumns returns the column names in a deterministic order
+func sortedColumns(columnTypes map[string]ColumnType) []string {
+	columns := make([]string, 0, len(columnTypes))
+	for column := range columnTypes {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns
+}
 
+// RecordKeys returns the sorted union of keys across the records
+func RecordKeys(records []models.Data) []string {
+	seen := make(map[string]bool)
 	var keys []string
-	var placeholders []string
-	var values []interface{}
+	for _, record := range records {
+		for key := range record {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CreateUniqueIndex creates a unique index on the key columns, serving as the conflict target for upserts
+func CreateUniqueIndex(tableName string, keys []string) error {
+	db, err := GetDB()
+	if err != nil {
+		return err
+	}
+
+	indexSQL := fmt.Sprintf(
+		`CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (%s)`,
+		quoteIdent(derivedName(tableName, "_key")),
+		quoteIdent(tableName),
+		quoteColumns(keys),
+	)
+	return execDDL(db, "create_index", indexSQL)
+}
+
+// QuarantineTableName returns the name of the table holding the records a table refused
+func QuarantineTableName(tableName string) string {
+	return derivedName(tableName, quarantineSuffix)
+}
+
+// CreateQuarantineTable creates the table holding refused records, with the route they came from and the error
+func CreateQuarantineTable(tx *gorm.DB, quarantineTable string) error {
+	createSQL := fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s ("_route_id" TEXT, "_record" JSONB, "_error" TEXT, "_quarantined_at" TIMESTAMPTZ NOT NULL DEFAULT now())`,
+		quoteIdent(quarantineTable),
+	)
+	return execDDL(tx, "create_quarantine_table", createSQL)
+}
+
+// InsertQuarantinedRecord stores a refused record along with the error that caused it to be refused
+func InsertQuarantinedRecord(tx *gorm.DB, quarantineTable string, routeID string, record models.Data, cause error) error {
+	bytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	insertSQL := fmt.Sprintf(
+		`INSERT INTO %s ("_route_id", "_record", "_error") VALUES ($1, $2, $3)`,
+		quoteIdent(quarantineTable),
+	)
+	return execSQL(tx, insertSQL, routeID, string(bytes), cause.Error())
+}
+
+// InsertOptions controls how InsertRecords resolves rows conflicting with existing rows
+type InsertOptions struct {
+	Mode string   // WriteModeAppend (default), WriteModeUpsert or WriteModeInsertIgnore
+	Keys []string // Conflict target, required for upsert
+}
+
+// InsertRecords inserts the records using multi-row INSERT statements on the given connection or transaction.
+// Records are grouped by their set of keys, such that omitted keys take the column default, and each statement is
+// bounded by the postgres limit on bind parameters. It returns the rows inserted or updated, rows skipped on conflict
+// are not counted.
+func InsertRecords(tx *gorm.DB, tableName string, records []models.Data, columnTypes map[string]ColumnType, opts InsertOptions) (int64, error) {
+	var affected int64
+	for _, group := range groupByKeys(records) {
+		// A record without any keys still produces a row
+		if len(group.keys) == 0 {
+			for range group.records {
+				rows, err := execSQLRows(tx, fmt.Sprintf(`INSERT INTO %s DEFAULT VALUES`, quoteIdent(tableName)))
+				if err != nil {
+					return affected, err
+				}
+				affected += rows
+			}
+			continue
+		}
 
-	i := 1
-	for key, value := range record {
-		// Quote column names
-		keys = append(keys, fmt.Sprintf(`"%s"`, key))
-		placeholders = append(placeholders, fmt.Sprintf("$%d", i))
-		values = append(values, value)
-		i++
+		rowsPerStatement := maxQueryParameters / len(group.keys)
+		for start := 0; start < len(group.records); start += rowsPerStatement {
+			end := min(start+rowsPerStatement, len(group.records))
+			rows, err := insertRows(tx, tableName, group.keys, group.records[start:end], columnTypes, opts)
+			if err != nil {
+				return affected, err
+			}
+			affected += rows
+		}
+	}
+	return affected, nil
+}
+
+// insertRows inserts the rows in a single multi-row INSERT statement, every row must carry exactly the given keys. It
+// returns the rows inserted or updated.
+func insertRows(tx *gorm.DB, tableName string, keys []string, rows []models.Data, columnTypes map[string]ColumnType, opts InsertOptions) (int64, error) {
+	tuples := make([]string, 0, len(rows))
+	values := make([]interface{}, 0, len(rows)*len(keys))
+	placeholders := make([]string, len(keys))
+	for _, row := range rows {
+		for i, key := range keys {
+			converted, err := ConvertValue(columnTypes[key], row[key])
+			if err != nil {
+				return 0, fmt.Errorf("%w: column %s: %v", ErrInvalidRecord, key, err)
+			}
+			values = append(values, converted)
+			placeholders[i] = fmt.Sprintf("$%d", len(values))
+		}
+		tuples = append(tuples, "("+strings.Join(placeholders, ", ")+")")
 	}
 
 	// Quote table name to handle names starting with numbers
 	insertSQL := fmt.Sprintf(
-		`INSERT INTO "%s" (%s) VALUES (%s)`,
-		tableName,
-		strings.Join(keys, ", "),
-		strings.Join(placeholders, ", "),
+		`INSERT INTO %s (%s) VALUES %s%s`,
+		quoteIdent(tableName),
+		quoteColumns(keys),
+		strings.Join(tuples, ", "),
+		onConflictClause(keys, opts),
 	)
 
-	return db.Exec(insertSQL, values...).Error
+	return execSQLRows(tx, insertSQL, values...)
+}
+
+// onConflictClause renders the ON CONFLICT clause for the write mode, upserts update every non-key column present
+// in the rows
+func onConflictClause(columns []string, opts InsertOptions) string {
+	target := ""
+	if len(opts.Keys) > 0 {
+		target = " (" + quoteColumns(opts.Keys) + ")"
+	}
+
+	switch opts.Mode {
+	case WriteModeInsertIgnore:
+		return " ON CONFLICT" + target + " DO NOTHING"
+	case WriteModeUpsert:
+		isKey := make(map[string]bool, len(opts.Keys))
+		for _, key := range opts.Keys {
+			isKey[key] = true
+		}
+
+		var assignments []string
+		for _, column := range columns {
+			if !isKey[column] {
+				assignments = append(assignments, fmt.Sprintf(`%s = EXCLUDED.%s`, quoteIdent(column), quoteIdent(column)))
+			}
+		}
+		if len(assignments) == 0 {
+			return " ON CONFLICT" + target + " DO NOTHING"
+		}
+		return " ON CONFLICT" + target + " DO UPDATE SET " + strings.Join(assignments, ", ")
+	}
+	return ""
+}
+
+// quoteColumns quotes and joins column names
+func quoteColumns(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdent(column)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// recordGroup is a set of records sharing the same keys
+type recordGroup struct {
+	keys    []string
+	records []models.Data
+}
+
+// groupByKeys groups records by their sorted set of keys, in order of first appearance
+func groupByKeys(records []models.Data) []*recordGroup {
+	var groups []*recordGroup
+	index := make(map[string]*recordGroup)
+	for _, record := range records {
+		keys := RecordKeys([]models.Data{record})
+		signature := strings.Join(keys, "\x00")
+		group, exists := index[signature]
+		if !exists {
+			group = &recordGroup{keys: keys}
+			index[signature] = group
+			groups = append(groups, group)
+		}
+		group.records = append(group.records, record)
+	}
+	return groups
 }
@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
+	"gorm.io/gorm"
+)
+
+// testDB connects to the database in TEST_DSN, skipping the test or benchmark without one
+func testDB(tb testing.TB) *gorm.DB {
+	tb.Helper()
+
+	testDSN := os.Getenv("TEST_DSN")
+	if testDSN == "" {
+		tb.Skip("TEST_DSN is not set")
+	}
+	dsn = testDSN
+
+	db, err := GetDB()
+	if err != nil {
+		tb.Fatalf("failed to connect to the test database: %v", err)
+	}
+	return db
+}
+
+// testTable creates a table with the columns, dropped once the test or benchmark is done
+func testTable(tb testing.TB, columns map[string]ColumnType) string {
+	tb.Helper()
+
+	table := "test_" + uuid.NewString()
+	if err := CreateTableFromMap(table, columns); err != nil {
+		tb.Fatalf("failed to create table %s: %v", table, err)
+	}
+	tb.Cleanup(func() {
+		if err := DropTable(table); err != nil {
+			tb.Errorf("failed to drop table %s: %v", table, err)
+		}
+	})
+	return table
+}
+
+// benchmarkRecords returns records with a column of each inferred type
+func benchmarkRecords(n int) []models.Data {
+	records := make([]models.Data, n)
+	for i := range records {
+		records[i] = models.Data{
+			"id":      float64(i),
+			"name":    fmt.Sprintf("record %d", i),
+			"score":   float64(i) + 0.5,
+			"active":  i%2 == 0,
+			"at":      time.Unix(int64(i), 0).UTC().Format(time.RFC3339),
+			"payload": map[string]any{"index": float64(i)},
+		}
+	}
+	return records
+}
+
+func TestInsertRecordsCountsRowsAffected(t *testing.T) {
+	db := testDB(t)
+
+	records := []models.Data{{"id": float64(1), "name": "a"}, {"id": float64(2), "name": "b"}}
+	columns := InferColumnTypes(records)
+	table := testTable(t, columns)
+	if err := CreateUniqueIndex(table, []string{"id"}); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := []models.Data{{"id": float64(1), "name": "c"}, {"id": float64(2), "name": "d"}, {"id": float64(3), "name": "e"}}
+	for _, step := range []struct {
+		mode    string
+		records []models.Data
+		want    int64
+	}{
+		{WriteModeInsertIgnore, records, 2},
+		{WriteModeInsertIgnore, changed, 1}, // ids 1 and 2 exist and are skipped
+		{WriteModeUpsert, changed, 3},       // existing rows are updated
+	} {
+		rows, err := InsertRecords(db, table, step.records, columns, InsertOptions{Mode: step.mode, Keys: []string{"id"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows != step.want {
+			t.Errorf("%s of %d records affected %d rows, want %d", step.mode, len(step.records), rows, step.want)
+		}
+	}
+}
+
+// BenchmarkInsertRecords compares writing a batch with multi-row inserts in a single transaction, as flushes do, to
+// inserting each record in its own statement and implicit transaction, as flushes did before. It runs against the
+// database in TEST_DSN:
+//
+//	TEST_DSN=postgres://... go test ./pkg/handler -run '^$' -bench InsertRecords
+func BenchmarkInsertRecords(b *testing.B) {
+	db := testDB(b)
+
+	for _, size := range []int{100, 1000, 10000} {
+		records := benchmarkRecords(size)
+		columns := InferColumnTypes(records)
+
+		b.Run(fmt.Sprintf("per_row/%d", size), func(b *testing.B) {
+			table := testTable(b, columns)
+			batches := 0
+			for b.Loop() {
+				for _, record := range records {
+					if _, err := InsertRecords(db, table, []models.Data{record}, columns, InsertOptions{}); err != nil {
+						b.Fatal(err)
+					}
+				}
+				batches++
+			}
+			b.ReportMetric(float64(batches*size)/b.Elapsed().Seconds(), "rows/s")
+		})
+
+		b.Run(fmt.Sprintf("multi_row/%d", size), func(b *testing.B) {
+			table := testTable(b, columns)
+			batches := 0
+			for b.Loop() {
+				err := db.Transaction(func(tx *gorm.DB) error {
+					_, err := InsertRecords(tx, table, records, columns, InsertOptions{})
+					return err
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				batches++
+			}
+			b.ReportMetric(float64(batches*size)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
@@ -2,9 +2,49 @@ package handler
 
 import (
 	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/nats-io/nats.go"
 	"github.com/quantumwake/alethic-ism-core-go/pkg/repository/processor"
 	"github.com/quantumwake/alethic-ism-core-go/pkg/routing"
-	"time"
+	rnats "github.com/quantumwake/alethic-ism-core-go/pkg/routing/nats"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/utils"
+	"gorm.io/gorm"
+)
+
+var (
+	// Backoff applied when a message is negatively acknowledged, doubling per delivery attempt
+	nakDelayBase = utils.DurationFromEnvWithDefault("NAK_DELAY_BASE", 5*time.Second)
+	nakDelayMax  = utils.DurationFromEnvWithDefault("NAK_DELAY_MAX", 5*time.Minute)
+
+	// Interval at which the messages held by a writer until its batch is flushed are reported in progress, it must stay
+	// below the ack wait of the subscriber (30s by default) and is capped to a third of a configured ack_wait
+	ackProgressInterval = utils.DurationFromEnvWithDefault("ACK_PROGRESS_INTERVAL", 10*time.Second)
+)
+
+var (
+	// Terminal errors, the message can never succeed so it is consumed rather than redelivered
+	ErrRouteNotFound  = errors.New("route not found")
+	ErrInvalidMessage = errors.New("invalid message")
+	ErrInvalidConfig  = errors.New("invalid processor config")
+	ErrInvalidRecord  = errors.New("invalid record")
+	ErrSchemaConflict = errors.New("schema conflict")
+)
+
+var (
+	// Transient errors, the message is redelivered
+	ErrWriterClosed = errors.New("batch writer is closed")
+	ErrShuttingDown = errors.New("shutting down")
 )
 
 // ---- reusable finalizer ----
@@ -13,6 +53,7 @@ type AckAction int
 
 const (
 	AckOnSuccess AckAction = iota // always ACK on success
+	AckDeferred                   // on success the ack is owned elsewhere (e.g. by a batch writer once flushed)
 )
 
 type FinalizerOptions struct {
@@ -23,66 +64,218 @@ type FinalizerOptions struct {
 	RetErr     *error // pointer to caller's named return err
 	// Per-consumer classification and policy:
 	IsTerminal func(error) bool          // REQUIRED: decide terminal vs transient
-	NakDelay   func(error) time.Duration // OPTIONAL: delay for transient; default 1m
+	NakDelay   func(error) time.Duration // OPTIONAL: delay for transient; default exponential backoff on delivery count
 	PanicTerm  bool                      // if true => treat panic as terminal (ACK); else transient (NAK)
+	Ack        AckAction                 // what to do with the message on success
 	// Hooks (optional)
 	OnPublish func(ctx context.Context, routeID string, status processor.Status, note string, qstate any)
 }
 
-//func Finalize(opts FinalizerOptions) {
-//	defer func(Msg routing.MessageEnvelop, ctx context.Context) {
-//		err := Msg.Ack(ctx)
-//		if err != nil {
-//			fmt.Printf("error acking message in finalizer: %v\n", err)
-//		}
-//	}(opts.Msg, opts.Ctx)
-
-//
-//publish := func(st processor.Status, note string, q any) {
-//	if opts.OnPublish != nil {
-//		opts.OnPublish(opts.Ctx, opts.RouteID, st, note, q)
-//	} else if opts.RouteID != "" { // only publish if we have a route context
-//		PublishRouteStatus(opts.Ctx, opts.RouteID, st, note, q)
-//	}
-//}
-//
-////defer func() {
-//if rec := recover(); rec != nil {
-//	note := fmt.Sprintf("panic: %v\n%s", rec, debug.Stack())
-//	publish(processor.Failed, note, opts.QueryState)
-//	if opts.PanicTerm {
-//		_ = opts.Msg.Ack(opts.Ctx) // consume (no retry)
-//	} else {
-//		delay := time.Minute
-//		if opts.NakDelay != nil {
-//			delay = opts.NakDelay(fmt.Errorf("panic"))
-//		}
-//		_ = opts.Msg.NakWithDelay(opts.Ctx, delay)
-//	}
-//	return
-//}
-//
-//if opts.RetErr != nil && *opts.RetErr != nil {
-//	err := *opts.RetErr
-//	term := false
-//	if opts.IsTerminal != nil {
-//		term = opts.IsTerminal(err)
-//	}
-//	publish(processor.Failed, err.Error(), opts.QueryState)
-//	if term {
-//		_ = opts.Msg.Ack(opts.Ctx) // drop (no retry)
-//	} else {
-//		delay := time.Minute
-//		if opts.NakDelay != nil {
-//			delay = opts.NakDelay(err)
-//		}
-//		_ = opts.Msg.NakWithDelay(opts.Ctx, delay)
-//	}
-//	return
-//}
-
-// success
-//publish(processor.Completed, "", nil)
-
-//}()
-//}
+// Finalize settles the message once the caller returns, it must be deferred directly (defer Finalize(opts)) so
+// that panics can be recovered. The options are taken by pointer so fields learned during processing (e.g. the
+// route id) are visible to the finalizer.
+func Finalize(opts *FinalizerOptions) {
+	publish := func(st processor.Status, note string, q any) {
+		if opts.OnPublish != nil {
+			opts.OnPublish(opts.Ctx, opts.RouteID, st, note, q)
+		} else if opts.RouteID != "" { // only publish if we have a route context
+			PublishRouteStatus(opts.Ctx, opts.RouteID, st, note, q)
+		}
+	}
+
+	if rec := recover(); rec != nil {
+		note := fmt.Sprintf("panic: %v\n%s", rec, debug.Stack())
+		log.Print(note)
+		publish(processor.Failed, note, opts.QueryState)
+		if opts.PanicTerm {
+			ackMessage(opts.Ctx, opts.Msg) // consume (no retry)
+		} else {
+			nakMessage(opts.Ctx, opts.Msg, opts.nakDelay(fmt.Errorf("panic: %v", rec)))
+		}
+		return
+	}
+
+	if opts.RetErr != nil && *opts.RetErr != nil {
+		err := *opts.RetErr
+		term := false
+		if opts.IsTerminal != nil {
+			term = opts.IsTerminal(err)
+		}
+		log.Printf("error processing message on route %q (terminal: %v): %v\n", opts.RouteID, term, err)
+		publish(processor.Failed, err.Error(), opts.QueryState)
+		if term {
+			ackMessage(opts.Ctx, opts.Msg) // drop (no retry)
+		} else {
+			nakMessage(opts.Ctx, opts.Msg, opts.nakDelay(err))
+		}
+		return
+	}
+
+	// success, status is published by whoever ends up owning the message
+	if opts.Ack == AckOnSuccess {
+		ackMessage(opts.Ctx, opts.Msg)
+	}
+}
+
+// nakDelay returns the redelivery delay for a transient error
+func (opts *FinalizerOptions) nakDelay(err error) time.Duration {
+	if opts.NakDelay != nil {
+		return opts.NakDelay(err)
+	}
+	return NakBackoff(opts.Msg)
+}
+
+// Settle acks a message whose processing failed with a terminal error, or naks it with backoff when the error
+// is transient, for messages settled outside the scope of Finalize (e.g. refused before reaching a batch writer)
+func Settle(ctx context.Context, msg routing.MessageEnvelop, err error) {
+	if IsTerminalError(err) {
+		ackMessage(ctx, msg)
+		return
+	}
+	nakMessage(ctx, msg, NakBackoff(msg))
+}
+
+// NakBackoff returns an exponential redelivery delay based on how many times the message has been delivered,
+// bounded by NAK_DELAY_MAX. Messages without delivery metadata get the base delay.
+func NakBackoff(msg routing.MessageEnvelop) time.Duration {
+	attempt := uint64(1)
+	if envelop, ok := msg.(*rnats.MessageEnvelop); ok && envelop.Msg != nil {
+		if meta, err := envelop.Msg.Metadata(); err == nil && meta.NumDelivered > 0 {
+			attempt = meta.NumDelivered
+		}
+	}
+
+	delay := float64(nakDelayBase) * math.Pow(2, float64(attempt-1))
+	if delay > float64(nakDelayMax) {
+		return nakDelayMax
+	}
+	return time.Duration(delay)
+}
+
+func ackMessage(ctx context.Context, msg routing.MessageEnvelop) {
+	if err := msg.Ack(ctx); err != nil {
+		log.Printf("error acking message in finalizer: %v\n", err)
+	}
+}
+
+func nakMessage(ctx context.Context, msg routing.MessageEnvelop, delay time.Duration) {
+	if err := msg.NakWithDelay(ctx, delay); err != nil {
+		log.Printf("error nacking message in finalizer: %v\n", err)
+	}
+}
+
+// progressMessage tells the broker a held message is still being processed, restarting its ack wait such that it is
+// not redelivered while its batch waits to be flushed. Messages without an ack wait (e.g. core nats) are left as is.
+func progressMessage(msg routing.MessageEnvelop) {
+	var err error
+	switch m := msg.(type) {
+	case interface{ InProgress() error }:
+		err = m.InProgress()
+	case *rnats.MessageEnvelop:
+		if m.Msg == nil || m.Msg.Reply == "" {
+			return
+		}
+		err = m.Msg.InProgress()
+	}
+	if err != nil {
+		log.Printf("error reporting message in progress: %v\n", err)
+	}
+}
+
+// IsTerminalError classifies an error as terminal, retrying cannot help and the message is consumed: a missing route
+// or processor, a malformed message or record, an invalid configuration, a missing confirmation or a conflicting
+// schema. Any other error is transient and the message redelivered with backoff, such that an error path not
+// classified here (e.g. a network or filesystem error) delays records rather than losing them.
+func IsTerminalError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, ErrRouteNotFound),
+		errors.Is(err, ErrInvalidMessage),
+		errors.Is(err, ErrInvalidConfig),
+		errors.Is(err, ErrInvalidRecord),
+		errors.Is(err, ErrConfirmationRequired),
+		errors.Is(err, ErrSchemaConflict),
+		errors.Is(err, gorm.ErrRecordNotFound),
+		errors.As(err, &syntaxErr),
+		errors.As(err, &typeErr):
+		return true
+	}
+	return false
+}
+
+// IsTransientError reports whether an error is likely to succeed if retried later
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	// timeouts, cancellations, full buffers, an unavailable database, paused processors, failed spool writes and
+	// messages received while shutting down
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || pgconn.Timeout(err) ||
+		errors.Is(err, ErrWriterClosed) || errors.Is(err, ErrShuttingDown) || errors.Is(err, ErrBufferFull) ||
+		errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrProcessorPaused) || errors.Is(err, ErrSpoolWrite) {
+		return true
+	}
+
+	// database connectivity
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) || errors.Is(err, driver.ErrBadConn) || pgconn.SafeToRetry(err) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return isTransientSQLState(pgErr.Code)
+	}
+
+	// nats publish failures
+	switch {
+	case errors.Is(err, nats.ErrTimeout),
+		errors.Is(err, nats.ErrConnectionClosed),
+		errors.Is(err, nats.ErrConnectionReconnecting),
+		errors.Is(err, nats.ErrDisconnected),
+		errors.Is(err, nats.ErrNoServers),
+		errors.Is(err, nats.ErrNoResponders):
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// isConnectionError reports whether the error means the database could not be reached, as opposed to a database
+// that refused a statement
+func isConnectionError(err error) bool {
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) || errors.Is(err, driver.ErrBadConn) || pgconn.Timeout(err) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return strings.HasPrefix(pgErr.Code, "08") || strings.HasPrefix(pgErr.Code, "57P")
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// isTransientSQLState reports whether a postgres SQLSTATE code denotes a retryable condition
+func isTransientSQLState(code string) bool {
+	switch {
+	case strings.HasPrefix(code, "08"): // connection exception
+		return true
+	case strings.HasPrefix(code, "53"): // insufficient resources
+		return true
+	case strings.HasPrefix(code, "57P"): // operator intervention (admin shutdown, crash shutdown, cannot connect now)
+		return true
+	case code == "40001", code == "40P01": // serialization failure, deadlock detected
+		return true
+	}
+	return false
+}
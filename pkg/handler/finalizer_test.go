@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+func TestIsTerminalError(t *testing.T) {
+	var syntaxErr error = &json.SyntaxError{}
+	for _, test := range []struct {
+		name     string
+		err      error
+		terminal bool
+	}{
+		{"nil", nil, false},
+		{"route not found", fmt.Errorf("%w: route", ErrRouteNotFound), true},
+		{"processor not found", fmt.Errorf("failed to fetch processor: %w", gorm.ErrRecordNotFound), true},
+		{"invalid message", fmt.Errorf("%w: empty", ErrInvalidMessage), true},
+		{"invalid config", fmt.Errorf("%w: unknown write mode", ErrInvalidConfig), true},
+		{"invalid record", fmt.Errorf("%w: column id", ErrInvalidRecord), true},
+		{"confirmation required", fmt.Errorf("%w: confirm with the table name", ErrConfirmationRequired), true},
+		{"schema conflict", fmt.Errorf("failed to resolve column: %w", ErrSchemaConflict), true},
+		{"malformed json", fmt.Errorf("error unmarshalling route message: %w", syntaxErr), true},
+		{"circuit open", ErrCircuitOpen, false},
+		{"buffer full", fmt.Errorf("%w: table", ErrBufferFull), false},
+		{"shutting down", ErrShuttingDown, false},
+		{"deadline", fmt.Errorf("flush: %w", context.DeadlineExceeded), false},
+		{"connection refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, false},
+		{"connection exception", &pgconn.PgError{Code: "08006"}, false},
+		{"constraint violation", &pgconn.PgError{Code: "23505"}, false},
+		{"disk full", fmt.Errorf("%w of table t: %w", ErrSpoolWrite, &fs.PathError{Op: "write", Err: syscall.ENOSPC}), false},
+		{"unclassified", errors.New("something unexpected"), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsTerminalError(test.err); got != test.terminal {
+				t.Errorf("IsTerminalError(%v) = %v, want %v", test.err, got, test.terminal)
+			}
+		})
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"nil", nil, false},
+		{"deadline", context.DeadlineExceeded, true},
+		{"connection refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{"connection exception", &pgconn.PgError{Code: "08006"}, true},
+		{"insufficient resources", &pgconn.PgError{Code: "53100"}, true},
+		{"serialization failure", &pgconn.PgError{Code: "40001"}, true},
+		{"admin shutdown", &pgconn.PgError{Code: "57P01"}, true},
+		{"spool write", fmt.Errorf("%w of table t: %w", ErrSpoolWrite, &fs.PathError{Op: "write", Err: syscall.ENOSPC}), true},
+		{"constraint violation", &pgconn.PgError{Code: "23505"}, false},
+		{"invalid record", ErrInvalidRecord, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsTransientError(test.err); got != test.transient {
+				t.Errorf("IsTransientError(%v) = %v, want %v", test.err, got, test.transient)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/repository/processor"
+)
+
+// ForwardConfig configures the publishing of written records downstream, such that a state tables processor can
+// sit in the middle of a flow rather than only at its end. Only the records that inserted or changed a row are
+// forwarded: unchanged history records are not, nor are the records of a route skipped on conflict altogether.
+type ForwardConfig struct {
+	StateSync bool `json:"stateSync,omitempty"` // publish the records to the state sync route, for each output route of the processor
+	Outbound  bool `json:"outbound,omitempty"`  // publish the records to the output routes of the processor, through the state router
+	RowID     bool `json:"rowId,omitempty"`     // add a generated _row_id (uuid) column to each record
+	Timestamp bool `json:"timestamp,omitempty"` // add the _timestamp column to each record, as includeTimestamp does
+}
+
+// Enabled reports whether the records are published anywhere
+func (f *ForwardConfig) Enabled() bool {
+	return f != nil && (f.StateSync || f.Outbound)
+}
+
+// forward publishes the records that changed the table, as ingested (keyed by record key), to the configured
+// destinations for each output route of the processor. Failures are logged, the records are already committed (must
+// be called with lock held).
+func (bw *BatchWriter) forward(changed []batchRecord) {
+	if len(changed) == 0 || !bw.config.Forward.Enabled() {
+		return
+	}
+
+	outputs, err := routeBackend.FindRouteByProcessorAndDirection(bw.config.ProcessorID, processor.DirectionOutput)
+	if err != nil {
+		log.Printf("error finding output routes of processor %s to forward table %s: %v\n", bw.config.ProcessorID, bw.tableName, err)
+		return
+	}
+	if len(outputs) == 0 {
+		return
+	}
+
+	queryState := batchData(changed)
+	ctx := context.Background()
+	for _, output := range outputs {
+		if bw.config.Forward.StateSync {
+			PublishStateSync(ctx, output.ID, queryState)
+		}
+		if bw.config.Forward.Outbound {
+			if err = PublishStateRoute(ctx, output.ID, queryState); err != nil {
+				publishFailures.WithLabelValues("router").Inc()
+				log.Printf("error forwarding table %s to route %s: %v\n", bw.tableName, output.ID, err)
+			}
+		}
+	}
+}
+
+// PublishStateRoute publishes the records to an output route through the state router, connecting to the router on
+// first use
+func PublishStateRoute(ctx context.Context, routeID string, queryState []models.Data) error {
+	router, err := stateRouter(ctx)
+	if err != nil {
+		return err
+	}
+
+	routeMessage := models.RouteMessage{
+		Type:       models.QueryStateRoute,
+		RouteID:    routeID,
+		QueryState: queryState,
+	}
+
+	log.Printf("Sending state to state router route: %v\n", routeID)
+
+	if err = router.Publish(ctx, routeMessage); err != nil {
+		return fmt.Errorf("unable to publish to state router: %w", err)
+	}
+	if err = router.Flush(); err != nil {
+		return fmt.Errorf("unable to flush state router: %w", err)
+	}
+	return nil
+}
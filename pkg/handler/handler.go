@@ -3,63 +3,90 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
 	"github.com/quantumwake/alethic-ism-core-go/pkg/routing"
-	"log"
+	"gorm.io/gorm"
 )
 
 func MessageCallback(ctx context.Context, msg routing.MessageEnvelop) {
+	// messages delivered once the intake is closed are redelivered, to this or another instance
+	if !beginCallback() {
+		Settle(ctx, msg, ErrShuttingDown)
+		return
+	}
+	defer endCallback()
+	messagesReceived.Inc()
 
-	defer func() {
-		err := msg.Ack(ctx)
-		if err != nil {
-			fmt.Printf("error acking message in finalizer: %v\n", err)
-		}
-	}()
+	var err error
+
+	// settle the message on return: failures are published and acked (terminal) or nacked (transient), and once
+	// the records are handed to a batch writer the writer owns the ack (after the batch is flushed)
+	opts := &FinalizerOptions{
+		Ctx:        ctx,
+		Msg:        msg,
+		RetErr:     &err,
+		IsTerminal: IsTerminalError,
+		NakDelay:   nil,
+		PanicTerm:  true,
+		Ack:        AckOnSuccess,
+		OnPublish:  nil, // Status publishing handled by batch flush
+	}
+	defer Finalize(opts)
 
 	ingestedRawMessage, err := msg.MessageRaw()
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+		return
+	}
 
 	// unmarshal the message into a map object for processing the message ingestedRawMessage and metadata fields (e.g. binding)
 	var ingestedRouteMsg models.RouteMessage
-	err = json.Unmarshal(ingestedRawMessage, &ingestedRouteMsg)
-	if err != nil {
-		log.Printf("error unmarshalling route message: %v\n", err)
+	if err = json.Unmarshal(ingestedRawMessage, &ingestedRouteMsg); err != nil {
+		err = fmt.Errorf("error unmarshalling route message: %w", err)
 		return
 	}
+	opts.RouteID = ingestedRouteMsg.RouteID
+	opts.QueryState = ingestedRouteMsg.QueryState
 
-	//defer Finalize(FinalizerOptions{
-	//	Ctx:        ctx,
-	//	Msg:        msg,
-	//	RouteID:    ingestedRouteMsg.RouteID,
-	//	QueryState: ingestedRouteMsg.QueryState,
-	//	RetErr:     &err,
-	//	IsTerminal: IsTerminalError,
-	//	NakDelay:   nil,
-	//	PanicTerm:  true,
-	//	OnPublish:  nil, // Status publishing handled by batch flush
-	//})
+	// consumption pauses while the database is unavailable, messages are redelivered with backoff unless they can be
+	// spooled until it recovers
+	if dbBreaker.Open() && !spoolEnabled() {
+		dbBreaker.degrade(ingestedRouteMsg.RouteID)
+		Settle(ctx, msg, ErrCircuitOpen)
+		opts.Ack = AckDeferred
+		return
+	}
 
-	route, err := routeBackend.FindRouteByID(ingestedRouteMsg.RouteID)
+	route, err := findRoute(ingestedRouteMsg.RouteID)
 	if err != nil {
-		log.Printf("error finding route: %v\n", err)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = fmt.Errorf("%w: %s", ErrRouteNotFound, ingestedRouteMsg.RouteID)
+		} else {
+			err = fmt.Errorf("error finding route %s: %w", ingestedRouteMsg.RouteID, err)
+		}
+		return
+	}
+
+	// messages of a paused processor are redelivered with backoff until it is resumed
+	if IsPaused(route.ProcessorID) {
+		Settle(ctx, msg, ErrProcessorPaused)
+		opts.Ack = AckDeferred
 		return
 	}
 
 	config, err := getProcessorConfig(route.ProcessorID)
 	if err != nil {
-		log.Printf("error getting processor config for processor ID %v: %v\n", route.ProcessorID, err)
+		err = fmt.Errorf("error getting processor config for processor ID %v: %w", route.ProcessorID, err)
 		return
 	}
 
-	// Get or create batch writer for this processor
-	writer := GetBatchWriter(route.ProcessorID, config)
-
-	// Add records to batch (will auto-flush based on config thresholds)
-	// Status will be published when the batch flushes
-	err = writer.Add(ingestedRouteMsg.RouteID, ingestedRouteMsg.QueryState)
-}
-
-func IsTerminalError(err error) bool {
-	return true
+	// Add records to the batch writer of this processor (will auto-flush based on config thresholds)
+	// Status will be published and the message acked when the batch flushes
+	if err = AddRecords(route.ProcessorID, config, msg, ingestedRouteMsg.RouteID, ingestedRouteMsg.QueryState, int64(len(ingestedRawMessage))); err != nil {
+		err = fmt.Errorf("error adding records to batch writer for processor ID %v: %w", route.ProcessorID, err)
+		return
+	}
+	opts.Ack = AckDeferred
 }
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/repository/processor"
+)
+
+func TestMessagesAreSpooledWhileDatabaseIsUnreachable(t *testing.T) {
+	processorID, routeID := uuid.NewString(), uuid.NewString()
+	unreachable := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+	// the lookups and the catalog reach the database until it goes down
+	var down atomic.Bool
+	findRoute, findProcessor, register, dir := findRouteByID, findProcessorByID, registerTable, spoolDir
+	findRouteByID = func(id string) (*processor.State, error) {
+		if down.Load() {
+			return nil, unreachable
+		}
+		return &processor.State{ID: id, ProcessorID: processorID}, nil
+	}
+	findProcessorByID = func(id string) (*processor.Processor, error) {
+		if down.Load() {
+			return nil, unreachable
+		}
+		return &processor.Processor{ID: id}, nil
+	}
+	registerTable = func(string, string, string) error {
+		if down.Load() {
+			return unreachable
+		}
+		return nil
+	}
+	spoolDir = t.TempDir()
+	t.Cleanup(func() {
+		findRouteByID, findProcessorByID, registerTable, spoolDir = findRoute, findProcessor, register, dir
+	})
+	t.Cleanup(func() { writerCache.evict(processorID) })
+
+	deliver := func(id int) *testMessage {
+		msg := &testMessage{raw: []byte(fmt.Sprintf(`{"route_id": %q, "query_state": [{"id": %d}]}`, routeID, id))}
+		MessageCallback(context.Background(), msg)
+		return msg
+	}
+
+	if msg := deliver(1); msg.acks.Load() != 1 || msg.naks.Load() != 0 {
+		t.Fatalf("message spooled while the database is reachable was acked %d and nacked %d times, want acked once",
+			msg.acks.Load(), msg.naks.Load())
+	}
+	writerCache.evict(processorID)
+
+	// the database goes down, the last route and configuration found are served and the writer is created without
+	// claiming its table, both before and after the circuit opens
+	down.Store(true)
+	if msg := deliver(2); msg.acks.Load() != 1 || msg.naks.Load() != 0 {
+		t.Errorf("message received while the database is unreachable was acked %d and nacked %d times, want acked once",
+			msg.acks.Load(), msg.naks.Load())
+	}
+	writerCache.evict(processorID)
+
+	dbBreaker.mu.Lock()
+	dbBreaker.open = true
+	dbBreaker.mu.Unlock()
+	t.Cleanup(func() {
+		dbBreaker.mu.Lock()
+		dbBreaker.open = false
+		dbBreaker.routes = make(map[string]bool)
+		dbBreaker.mu.Unlock()
+	})
+	if msg := deliver(3); msg.acks.Load() != 1 || msg.naks.Load() != 0 {
+		t.Errorf("message received while the circuit is open was acked %d and nacked %d times, want acked once",
+			msg.acks.Load(), msg.naks.Load())
+	}
+}
@@ -0,0 +1,191 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/utils"
+)
+
+const (
+	watchdogInterval = time.Second      // How often the watchdog records a heartbeat
+	watchdogStall    = 30 * time.Second // Heartbeats older than this mean the process is wedged
+)
+
+var (
+	// Flushes running longer than this mean the writer is wedged, e.g. on a database call that never returns
+	healthFlushStall = utils.DurationFromEnvWithDefault("HEALTH_FLUSH_STALL", 5*time.Minute)
+
+	// Bound on each readiness check reaching a dependency
+	healthCheckTimeout = utils.DurationFromEnvWithDefault("HEALTH_CHECK_TIMEOUT", 2*time.Second)
+
+	heartbeat atomic.Int64 // Unix nanoseconds of the last watchdog heartbeat
+)
+
+const (
+	HealthOK          = "ok"
+	HealthUnavailable = "unavailable"
+)
+
+// HealthCheck is the outcome of a single health check
+type HealthCheck struct {
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+	Detail any    `json:"detail,omitempty"`
+}
+
+// HealthReport is the outcome of the health checks of a probe, the status is ok only when every check is
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// StalledFlush describes a writer whose flush has been running longer than HEALTH_FLUSH_STALL
+type StalledFlush struct {
+	ProcessorID string `json:"processor_id"`
+	Table       string `json:"table"`
+	RunningFor  string `json:"running_for"`
+}
+
+// watchdog records a heartbeat every interval, a stale heartbeat means goroutines are no longer being scheduled
+func watchdog(ctx context.Context) {
+	heartbeat.Store(time.Now().UnixNano())
+
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			heartbeat.Store(time.Now().UnixNano())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Liveness reports whether the process is alive: the watchdog is beating and no writer is wedged in a flush
+func Liveness() HealthReport {
+	checks := make(map[string]HealthCheck)
+
+	since := time.Since(time.Unix(0, heartbeat.Load()))
+	checks["watchdog"] = checkResult(since < watchdogStall, fmt.Errorf("no heartbeat for %v", since.Round(time.Second)), nil)
+
+	stalled := stalledFlushes()
+	checks["flushes"] = checkResult(len(stalled) == 0, fmt.Errorf("%d flushes running longer than %v", len(stalled), healthFlushStall), stalled)
+
+	return newHealthReport(checks)
+}
+
+// Readiness reports whether the service can take on work: the database is reachable, the subscriber is connected,
+// the circuit is closed and the buffers have room
+func Readiness(ctx context.Context) HealthReport {
+	checks := make(map[string]HealthCheck)
+
+	err := withTimeout(ctx, pingDB)
+	checks["database"] = checkResult(err == nil, err, nil)
+
+	err = subscriberHealth(ctx)
+	checks["subscriber"] = checkResult(err == nil, err, nil)
+
+	checks["circuit"] = checkResult(!dbBreaker.Open(), ErrCircuitOpen, nil)
+
+	stats := GlobalBufferStats()
+	full := (stats.MaxRecords > 0 && stats.Records >= stats.MaxRecords) || (stats.MaxBytes > 0 && stats.Bytes >= stats.MaxBytes)
+	checks["buffers"] = checkResult(!full, ErrBufferFull, stats)
+
+	return newHealthReport(checks)
+}
+
+// subscriberHealth returns an error when the intake is closed or the subscriber route no longer reaches the server
+func subscriberHealth(ctx context.Context) error {
+	if !intakeOpen() {
+		return ErrShuttingDown
+	}
+	if subscriberRoute == nil {
+		return errors.New("subscriber route is not connected")
+	}
+	return withTimeout(ctx, subscriberRoute.Flush)
+}
+
+// withTimeout runs the check, giving up after HEALTH_CHECK_TIMEOUT or once the context is done
+func withTimeout(ctx context.Context, check func() error) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- check()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stalledFlushes returns the writers whose flush has been running longer than HEALTH_FLUSH_STALL
+func stalledFlushes() []StalledFlush {
+	writerCache.mu.RLock()
+	defer writerCache.mu.RUnlock()
+
+	var stalled []StalledFlush
+	for processorID, writer := range writerCache.writers {
+		// read without the writer lock, which a wedged flush holds
+		running := writer.running.Load()
+		if running == nil {
+			continue
+		}
+		if since := time.Since(running.started); since > healthFlushStall {
+			stalled = append(stalled, StalledFlush{
+				ProcessorID: processorID,
+				Table:       running.table,
+				RunningFor:  since.Round(time.Second).String(),
+			})
+		}
+	}
+	return stalled
+}
+
+// checkResult returns a passed check, or a failed check with the error
+func checkResult(ok bool, err error, detail any) HealthCheck {
+	if ok {
+		return HealthCheck{OK: true, Detail: detail}
+	}
+	return HealthCheck{OK: false, Error: err.Error(), Detail: detail}
+}
+
+// newHealthReport returns the report of the checks, failed when any check failed
+func newHealthReport(checks map[string]HealthCheck) HealthReport {
+	report := HealthReport{Status: HealthOK, Checks: checks}
+	for _, check := range checks {
+		if !check.OK {
+			report.Status = HealthUnavailable
+		}
+	}
+	return report
+}
+
+// serveHealth writes the report as json, with 503 Service Unavailable when it failed
+func serveHealth(w http.ResponseWriter, report HealthReport) {
+	status := http.StatusOK
+	if report.Status != HealthOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// handleHealthz serves the liveness probe
+func handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	serveHealth(w, Liveness())
+}
+
+// handleReadyz serves the readiness probe
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	serveHealth(w, Readiness(r.Context()))
+}
@@ -0,0 +1,257 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
+	"gorm.io/gorm"
+)
+
+// Columns maintained on history (slowly changing dimension type 2) tables
+const (
+	columnValidFrom = "_valid_from" // when this version became current
+	columnValidTo   = "_valid_to"   // when this version was superseded, null while current
+	columnIsCurrent = "_is_current" // whether this is the current version of its key
+	columnKeyHash   = "_key_hash"   // hash of the key column values, identifying the versions of a key
+	columnRowHash   = "_row_hash"   // hash of the tracked column values, used to detect changes
+)
+
+// historyColumns are the types of the columns maintained on history tables
+var historyColumns = map[string]ColumnType{
+	columnValidFrom: ColumnTimestamp,
+	columnValidTo:   ColumnTimestamp,
+	columnIsCurrent: ColumnBoolean,
+	columnKeyHash:   ColumnText,
+	columnRowHash:   ColumnText,
+}
+
+// isHistoryColumn reports whether a column is maintained by the history mode rather than taken from records
+func isHistoryColumn(column string) bool {
+	_, exists := historyColumns[column]
+	return exists
+}
+
+// EnsureHistoryColumns adds the version columns to a history table, along with a unique index guaranteeing a
+// single current version per key and an index to look up the versions of a key over time
+func EnsureHistoryColumns(tableName string, keys []string) error {
+	if err := AddColumns(tableName, historyColumns); err != nil {
+		return err
+	}
+
+	db, err := GetDB()
+	if err != nil {
+		return err
+	}
+
+	currentSQL := fmt.Sprintf(
+		`CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (%s) WHERE %s`,
+		quoteIdent(derivedName(tableName, "_current")), quoteIdent(tableName), quoteIdent(columnKeyHash), quoteIdent(columnIsCurrent),
+	)
+	if err = execDDL(db, "create_index", currentSQL); err != nil {
+		return err
+	}
+
+	historySQL := fmt.Sprintf(
+		`CREATE INDEX IF NOT EXISTS %s ON %s (%s, %s)`,
+		quoteIdent(derivedName(tableName, "_history")), quoteIdent(tableName), quoteColumns(keys), quoteIdent(columnValidFrom),
+	)
+	return execDDL(db, "create_index", historySQL)
+}
+
+// FindCurrentRowHashes returns the row hash of the current version of each of the given keys that has one
+func FindCurrentRowHashes(tx *gorm.DB, tableName string, keyHashes []string) (map[string]string, error) {
+	selectSQL := fmt.Sprintf(
+		`SELECT %s, %s FROM %s WHERE %s AND %s = ANY($1)`,
+		quoteIdent(columnKeyHash), quoteIdent(columnRowHash), quoteIdent(tableName), quoteIdent(columnIsCurrent), quoteIdent(columnKeyHash),
+	)
+	rows, err := querySQL(tx, selectSQL, keyHashes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	current := make(map[string]string, len(keyHashes))
+	for rows.Next() {
+		var keyHash, rowHash string
+		if err = rows.Scan(&keyHash, &rowHash); err != nil {
+			return nil, err
+		}
+		current[keyHash] = rowHash
+	}
+	return current, rows.Err()
+}
+
+// CloseCurrentVersions marks the current version of each key as superseded at the given time
+func CloseCurrentVersions(tx *gorm.DB, tableName string, validTo map[string]time.Time) error {
+	var tuples []string
+	var values []interface{}
+	flush := func() error {
+		if len(tuples) == 0 {
+			return nil
+		}
+
+		updateSQL := fmt.Sprintf(
+			`UPDATE %s AS t SET %s = v.valid_to, %s = FALSE FROM (VALUES %s) AS v(key_hash, valid_to) WHERE t.%s = v.key_hash AND t.%s`,
+			quoteIdent(tableName), quoteIdent(columnValidTo), quoteIdent(columnIsCurrent), strings.Join(tuples, ", "),
+			quoteIdent(columnKeyHash), quoteIdent(columnIsCurrent),
+		)
+		err := execSQL(tx, updateSQL, values...)
+		tuples, values = tuples[:0], values[:0]
+		return err
+	}
+
+	for keyHash, ts := range validTo {
+		values = append(values, keyHash, ts)
+		tuples = append(tuples, fmt.Sprintf("($%d::text, $%d::timestamptz)", len(values)-1, len(values)))
+		if len(values)+2 > maxQueryParameters {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// writeHistory writes the records as new versions of their keys. A record only produces a version when its tracked
+// columns differ from the previous version of its key; the version it supersedes, in the table or earlier in the
+// batch, is closed at the time the record was ingested. It returns the versions inserted per route and the records
+// they were inserted from (must be called with lock held)
+func (bw *BatchWriter) writeHistory(tx *gorm.DB, records []batchRecord) (map[string]int64, []batchRecord, error) {
+	keyHashes, versions := bw.groupByKey(records)
+	current, err := FindCurrentRowHashes(tx, bw.tableName, keyHashes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, changed, closes := bw.historyVersions(keyHashes, versions, current)
+	if err = CloseCurrentVersions(tx, bw.tableName, closes); err != nil {
+		return nil, nil, err
+	}
+	if _, err = InsertRecords(tx, bw.tableName, rows, bw.columns, InsertOptions{Mode: WriteModeAppend}); err != nil {
+		return nil, nil, err
+	}
+
+	inserted := make(map[string]int64) // versions per route
+	for _, record := range changed {
+		inserted[record.routeID]++
+	}
+	return inserted, changed, nil
+}
+
+// groupByKey groups the records per key hash in ingestion order, returning the key hashes in order of first
+// appearance (must be called with lock held)
+func (bw *BatchWriter) groupByKey(records []batchRecord) ([]string, map[string][]batchRecord) {
+	keys := bw.config.Keys()
+
+	var keyHashes []string
+	versions := make(map[string][]batchRecord)
+	for _, record := range records {
+		keyHash := hashValues(bw.keyValues(keys, record.data))
+		if _, exists := versions[keyHash]; !exists {
+			keyHashes = append(keyHashes, keyHash)
+		}
+		versions[keyHash] = append(versions[keyHash], record)
+	}
+	return keyHashes, versions
+}
+
+// historyVersions builds the versions to insert for the records of each key, given the row hash of the current
+// version of the keys that have one. It returns the rows to insert, the record each row is built from and the time
+// at which the current version of each changed key is closed (must be called with lock held)
+func (bw *BatchWriter) historyVersions(keyHashes []string, versions map[string][]batchRecord, current map[string]string) ([]models.Data, []batchRecord, map[string]time.Time) {
+	keys := bw.config.Keys()
+
+	var rows []models.Data
+	var changed []batchRecord
+	closes := make(map[string]time.Time)
+	for _, keyHash := range keyHashes {
+		previous, hasCurrent := current[keyHash]
+
+		// keep only the records that change the tracked columns, a later record ingested at the same time as the
+		// previous one replaces it rather than producing a zero length version
+		var changes []models.Data
+		var sources []batchRecord // of each change
+		for _, record := range versions[keyHash] {
+			rowHash := hashValues(bw.trackedValues(keys, record.data))
+			if rowHash == previous {
+				continue
+			}
+
+			row := make(models.Data, len(record.row)+len(historyColumns))
+			for key, value := range record.row {
+				row[key] = value
+			}
+			row[columnValidFrom] = record.ingestedAt
+			row[columnKeyHash] = keyHash
+			row[columnRowHash] = rowHash
+
+			if n := len(changes); n > 0 && changes[n-1][columnValidFrom].(time.Time).Equal(record.ingestedAt) {
+				changes[n-1], sources[n-1] = row, record
+			} else {
+				changes = append(changes, row)
+				sources = append(sources, record)
+			}
+			previous = rowHash
+		}
+
+		if len(changes) == 0 {
+			continue
+		}
+
+		if hasCurrent {
+			closes[keyHash] = changes[0][columnValidFrom].(time.Time)
+		}
+
+		for i, row := range changes {
+			last := i == len(changes)-1
+			row[columnIsCurrent] = last
+			if !last {
+				row[columnValidTo] = changes[i+1][columnValidFrom]
+			}
+			rows = append(rows, row)
+			changed = append(changed, sources[i])
+		}
+	}
+	return rows, changed, closes
+}
+
+// trackedValues returns the tracked column values of a record, as bound to their columns. Without configured
+// tracked columns every column is tracked except the key, generated and history columns (must be called with lock
+// held)
+func (bw *BatchWriter) trackedValues(keys []string, record models.Data) map[string]any {
+	tracked := make(map[string]any)
+	if len(bw.config.TrackedColumns) > 0 {
+		for _, column := range bw.config.TrackedColumns {
+			tracked[column] = bw.boundValue(column, record[column])
+		}
+		return tracked
+	}
+
+	isKey := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		isKey[key] = true
+	}
+
+	for column, value := range record {
+		if isKey[column] || isHistoryColumn(column) || column == "_timestamp" || column == "_row_id" || value == nil {
+			continue
+		}
+		tracked[column] = bw.boundValue(column, value)
+	}
+	return tracked
+}
+
+// hashValues returns a stable hash of the values, maps are hashed with sorted keys
+func hashValues(values any) string {
+	bytes, err := json.Marshal(values)
+	if err != nil {
+		bytes = []byte(fmt.Sprintf("%#v", values))
+	}
+	sum := sha256.Sum256(bytes)
+	return hex.EncodeToString(sum[:])
+}
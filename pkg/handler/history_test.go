@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
+)
+
+func TestHistoryVersions(t *testing.T) {
+	config := DefaultTableConfig()
+	config.KeyColumns = []string{"id"}
+	writer := &BatchWriter{config: config}
+
+	t0 := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	t1, t2 := t0.Add(time.Second), t0.Add(2*time.Second)
+	record := func(routeID string, at time.Time, data models.Data) batchRecord {
+		return batchRecord{routeID: routeID, data: data, row: data, ingestedAt: at}
+	}
+	records := []batchRecord{
+		record("a", t0, models.Data{"id": float64(1), "name": "x"}), // same as the current version of id 1
+		record("a", t1, models.Data{"id": float64(1), "name": "y"}),
+		record("a", t2, models.Data{"id": float64(1), "name": "z"}),
+		record("a", t0, models.Data{"id": float64(2), "name": "x"}),
+		record("b", t0, models.Data{"id": float64(2), "name": "y"}), // ingested at the same time, replaces the previous one
+		record("a", t1, models.Data{"id": float64(3), "name": "x"}),
+	}
+
+	keyHashes, versions := writer.groupByKey(records)
+	if len(keyHashes) != 3 {
+		t.Fatalf("grouped the records into %d keys, want 3", len(keyHashes))
+	}
+	current := map[string]string{
+		keyHashes[0]: hashValues(writer.trackedValues(config.Keys(), records[0].data)),
+		keyHashes[2]: hashValues(writer.trackedValues(config.Keys(), records[5].data)), // unchanged
+	}
+
+	rows, changed, closes := writer.historyVersions(keyHashes, versions, current)
+
+	want := []struct {
+		id        float64
+		name      string
+		validFrom time.Time
+		validTo   any
+		isCurrent bool
+	}{
+		{1, "y", t1, t2, false},
+		{1, "z", t2, nil, true},
+		{2, "y", t0, nil, true},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("built %d versions %v, want %d", len(rows), rows, len(want))
+	}
+	for i, row := range rows {
+		w := want[i]
+		if row["id"] != w.id || row["name"] != w.name || !row[columnValidFrom].(time.Time).Equal(w.validFrom) ||
+			row[columnValidTo] != w.validTo || row[columnIsCurrent] != w.isCurrent {
+			t.Errorf("version %d = %v, want %+v", i, row, w)
+		}
+	}
+
+	if len(changed) != len(rows) || changed[0].routeID != "a" || changed[2].routeID != "b" {
+		t.Errorf("versions built from %v, want one record per version and the last from route b", changed)
+	}
+	if len(closes) != 1 || !closes[keyHashes[0]].Equal(t1) {
+		t.Errorf("closed %v, want only the current version of id 1 closed at %v", closes, t1)
+	}
+}
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/utils"
+)
+
+var (
+	// Address of the HTTP server exposing the metrics, probes, admin and query APIs, disabled when empty
+	httpAddr = utils.StringFromEnvWithDefault("HTTP_ADDR", ":8080")
+
+	httpServer *http.Server
+)
+
+// StartHTTPServer serves the HTTP endpoints in the background, unless HTTP_ADDR is empty
+func StartHTTPServer(ctx context.Context) {
+	if httpAddr == "" {
+		return
+	}
+	go watchdog(ctx)
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /healthz", handleHealthz)
+	mux.HandleFunc("GET /readyz", handleReadyz)
+	registerAdminRoutes(mux)
+	registerQueryRoutes(mux)
+
+	httpServer = &http.Server{
+		Addr:              httpAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		log.Printf("serving http on %s\n", httpAddr)
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("error serving http: %v\n", err)
+		}
+	}()
+}
+
+// StopHTTPServer stops the HTTP server, waiting for the requests in flight until the context is done
+func StopHTTPServer(ctx context.Context) error {
+	if httpServer == nil {
+		return nil
+	}
+	return httpServer.Shutdown(ctx)
+}
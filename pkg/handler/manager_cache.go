@@ -1,10 +1,13 @@
 package handler
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"time"
 
-	"github.com/quantumwake/alethic-ism-core-go/pkg/repository/processor/tables"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/routing"
 )
 
 const (
@@ -16,7 +19,10 @@ var (
 	// Global cache for BatchWriter instances, one per processor
 	writerCache = &WriterCache{
 		writers:     make(map[string]*BatchWriter),
+		creating:    make(map[string]chan struct{}),
+		stopping:    make(map[string]chan struct{}),
 		stopCleanup: make(chan struct{}),
+		stopped:     make(chan struct{}),
 	}
 )
 
@@ -24,7 +30,10 @@ var (
 type WriterCache struct {
 	mu          sync.RWMutex
 	writers     map[string]*BatchWriter  // ProcessorID -> BatchWriter mapping
-	stopCleanup chan struct{}             // Signal to stop cleanup goroutine
+	creating    map[string]chan struct{} // Writers being created, closed once the writer is cached or its creation failed
+	stopping    map[string]chan struct{} // Evicted writers still draining, closed once the writer has stopped
+	stopCleanup chan struct{}            // Signal to stop cleanup goroutine
+	stopped     chan struct{}            // Closed once every writer has been stopped
 }
 
 func init() {
@@ -32,28 +41,153 @@ func init() {
 	go writerCache.cleanupRoutine()
 }
 
-// GetBatchWriter returns a cached BatchWriter for the given processor, creating one if needed
-func GetBatchWriter(processorID string, config *tables.TableProcessorConfig) *BatchWriter {
+// GetBatchWriter returns a lease on the cached BatchWriter for the given processor, creating one if needed. A cached
+// writer is reconfigured when the processor configuration has changed since it was created. The lease must be
+// released with Release once the caller is done with the writer, a leased writer is never evicted.
+func GetBatchWriter(processorID string, config *TableConfig) (*BatchWriter, error) {
+	writer, err := acquireBatchWriter(processorID, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = writer.Reconfigure(config); err != nil {
+		writer.Release()
+		return nil, err
+	}
+	return writer, nil
+}
+
+// acquireBatchWriter leases the cached writer, or creates and leases a new one. Leases are taken under the cache
+// lock such that cleanup, holding the write lock, never evicts a writer being leased. A writer is created outside the
+// cache lock, since it claims its table in the catalog and opens its spool, and only once per processor: concurrent
+// callers wait for the writer being created. An evicted writer owns the spool of its processor until it has stopped,
+// so no writer is created for the processor before then.
+func acquireBatchWriter(processorID string, config *TableConfig) (*BatchWriter, error) {
 	writerCache.mu.RLock()
 	if writer, exists := writerCache.writers[processorID]; exists {
+		writer.Acquire()
 		writerCache.mu.RUnlock()
-		return writer
+		return writer, nil
 	}
 	writerCache.mu.RUnlock()
 
-	// Create new writer with write lock
-	writerCache.mu.Lock()
-	defer writerCache.mu.Unlock()
-	
-	// Double-check pattern to avoid race conditions
-	if writer, exists := writerCache.writers[processorID]; exists {
-		return writer
+	for {
+		writerCache.mu.Lock()
+
+		// Double-check pattern to avoid race conditions
+		if writer, exists := writerCache.writers[processorID]; exists {
+			writer.Acquire()
+			writerCache.mu.Unlock()
+			return writer, nil
+		}
+
+		// wait for the writer being created, and look again
+		if created, exists := writerCache.creating[processorID]; exists {
+			writerCache.mu.Unlock()
+			<-created
+			continue
+		}
+
+		// wait for the evicted writer to drain, and look again
+		if stopped, exists := writerCache.stopping[processorID]; exists {
+			writerCache.mu.Unlock()
+			<-stopped
+			continue
+		}
+
+		created := make(chan struct{})
+		writerCache.creating[processorID] = created
+		writerCache.mu.Unlock()
+
+		writer, err := NewBatchWriter(processorID, config)
+
+		writerCache.mu.Lock()
+		delete(writerCache.creating, processorID)
+		if err == nil {
+			writer.Acquire()
+			writerCache.writers[processorID] = writer
+		}
+		writerCache.mu.Unlock()
+		close(created)
+
+		return writer, err
 	}
+}
+
+// AddRecords adds the records to the batch writer of the processor, under a lease. When the writer was stopped
+// concurrently (e.g. on shutdown) the records are transparently added to a fresh writer.
+func AddRecords(processorID string, config *TableConfig, msg routing.MessageEnvelop, routeID string, records []models.Data, size int64) error {
+	for {
+		writer, err := GetBatchWriter(processorID, config)
+		if err != nil {
+			return err
+		}
 
-	writer := NewBatchWriter(processorID, config)
-	writerCache.writers[processorID] = writer
-	
-	return writer
+		err = writer.Add(msg, routeID, records, size)
+		writer.Release()
+		if err == nil {
+			observeRecordsAdded(processorID, config.Table(), len(records))
+		}
+		if !errors.Is(err, ErrWriterClosed) {
+			return err
+		}
+	}
+}
+
+// cachedWriters returns the cached writers
+func cachedWriters() []*BatchWriter {
+	writerCache.mu.RLock()
+	defer writerCache.mu.RUnlock()
+
+	writers := make([]*BatchWriter, 0, len(writerCache.writers))
+	for _, writer := range writerCache.writers {
+		writers = append(writers, writer)
+	}
+	return writers
+}
+
+// cachedWriter returns the cached writer of a processor without creating one
+func cachedWriter(processorID string) (*BatchWriter, bool) {
+	writerCache.mu.RLock()
+	defer writerCache.mu.RUnlock()
+
+	writer, exists := writerCache.writers[processorID]
+	return writer, exists
+}
+
+// evict removes the writer of a processor from the cache regardless of its leases and stops it, returning false
+// when no writer is cached
+func (wc *WriterCache) evict(processorID string) bool {
+	wc.mu.Lock()
+	writer, exists := wc.writers[processorID]
+	if exists {
+		wc.retire(processorID)
+	}
+	wc.mu.Unlock()
+
+	if exists {
+		wc.stopRetired(processorID, writer)
+	}
+	return exists
+}
+
+// retire removes the writer of a processor from the cache and marks it as stopping, such that no writer is created
+// for the processor until stopRetired (must be called with lock held)
+func (wc *WriterCache) retire(processorID string) {
+	delete(wc.writers, processorID)
+	wc.stopping[processorID] = make(chan struct{})
+}
+
+// stopRetired stops a retired writer, flushing its remaining batch, and then lets a writer be created for its
+// processor again
+func (wc *WriterCache) stopRetired(processorID string, writer *BatchWriter) {
+	writer.Stop()
+
+	wc.mu.Lock()
+	stopped := wc.stopping[processorID]
+	delete(wc.stopping, processorID)
+	wc.mu.Unlock()
+	close(stopped)
 }
 
 // cleanupRoutine periodically removes idle BatchWriters
@@ -67,37 +201,64 @@ func (wc *WriterCache) cleanupRoutine() {
 			wc.cleanup()
 		case <-wc.stopCleanup:
 			wc.stopAll()
+			close(wc.stopped)
 			return
 		}
 	}
 }
 
-// cleanup removes BatchWriters that have been idle too long
+// cleanup removes BatchWriters that have been idle too long and are not leased. Evicted writers are removed from
+// the cache before being stopped, such that the cache is not locked while they drain their pending records; a later
+// lookup creates a fresh writer once the evicted one has stopped. Leases and last use are read without the writer
+// lock, such that a writer in the middle of a flush does not hold up the cache.
 func (wc *WriterCache) cleanup() {
 	wc.mu.Lock()
-	defer wc.mu.Unlock()
-
+	evicted := make(map[string]*BatchWriter)
 	now := time.Now()
 	for id, writer := range wc.writers {
-		if now.Sub(writer.LastUsed()) > maxIdleTime {
-			writer.Stop()  // Gracefully stop the writer
-			delete(wc.writers, id)
+		if !writer.Leased() && now.Sub(writer.LastUsed()) > maxIdleTime {
+			evicted[id] = writer
+			wc.retire(id)
 		}
 	}
+	wc.mu.Unlock()
+
+	for id, writer := range evicted {
+		wc.stopRetired(id, writer)
+	}
 }
 
-// stopAll gracefully stops all BatchWriters (called on shutdown)
+// stopAll gracefully stops all BatchWriters concurrently, flushing their batches (called on shutdown). The writers
+// are retired under the cache lock and stopped outside of it, such that the cache stays available while they drain.
 func (wc *WriterCache) stopAll() {
 	wc.mu.Lock()
-	defer wc.mu.Unlock()
+	writers := wc.writers
+	wc.writers = make(map[string]*BatchWriter)
+	for id := range writers {
+		wc.stopping[id] = make(chan struct{})
+	}
+	wc.mu.Unlock()
 
-	for _, writer := range wc.writers {
-		writer.Stop()
+	var wg sync.WaitGroup
+	for id, writer := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wc.stopRetired(id, writer)
+		}()
 	}
-	wc.writers = make(map[string]*BatchWriter)
+	wg.Wait()
 }
 
-// StopWriterCache gracefully shuts down the cache and all writers
-func StopWriterCache() {
+// StopWriterCache gracefully shuts down the cache and all writers, waiting until every writer has flushed its
+// remaining batch or the context is done
+func StopWriterCache(ctx context.Context) error {
 	close(writerCache.stopCleanup)
-}
\ No newline at end of file
+
+	select {
+	case <-writerCache.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,357 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/routing"
+)
+
+// testRows holds the rows written by the writers of each processor, in place of the database
+var testRows = struct {
+	sync.Mutex
+	byProcessor map[string][]models.Data
+}{byProcessor: make(map[string][]models.Data)}
+
+// testMonitor keeps the monitor messages published by the writers
+var testMonitor = &testRoute{}
+
+// TestMain runs the writers without a database or nats: tables are claimed without the catalog, batches are written
+// to testRows and monitor messages are kept by testMonitor. Writers outlive the test that created them while they
+// drain, so these are replaced once for the whole package rather than per test. Records with a true "skip" value are
+// written without affecting a row, as records skipped on conflict are, and those with a true "refuse" value are
+// quarantined.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "state-tables-test")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create spill directory: %v\n", err)
+		os.Exit(1)
+	}
+	spillDir = dir
+
+	monitorRoute = testMonitor
+	registerTable = func(string, string, string) error { return nil }
+	writeBatch = func(bw *BatchWriter) (writeResult, error) {
+		result := writeResult{rows: make(map[string]int64)}
+		testRows.Lock()
+		defer testRows.Unlock()
+		for _, record := range bw.batch {
+			if record.data["refuse"] == true {
+				result.quarantined = append(result.quarantined, quarantinedRecord{batchRecord: record, err: ErrInvalidRecord})
+				continue
+			}
+			result.written = append(result.written, record)
+			if record.data["skip"] != true {
+				testRows.byProcessor[bw.config.ProcessorID] = append(testRows.byProcessor[bw.config.ProcessorID], record.data)
+				result.changed = append(result.changed, record)
+				result.rows[record.routeID]++
+			}
+		}
+		return result, nil
+	}
+
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testRoute is a monitor route keeping the messages published to it
+type testRoute struct {
+	routing.Route
+	mu       sync.Mutex
+	messages []models.MonitorMessage
+}
+
+func (r *testRoute) Publish(_ context.Context, msg any) error {
+	if message, ok := msg.(models.MonitorMessage); ok {
+		r.mu.Lock()
+		r.messages = append(r.messages, message)
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+func (r *testRoute) Flush() error { return nil }
+
+// published returns the messages published to the route that match
+func (r *testRoute) published(match func(models.MonitorMessage) bool) []models.MonitorMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var messages []models.MonitorMessage
+	for _, message := range r.messages {
+		if match(message) {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+// testMessage is a message counting how often it is acknowledged, negatively acknowledged and reported in progress,
+// its payload is an empty object unless set
+type testMessage struct {
+	raw      []byte
+	acks     atomic.Int32
+	naks     atomic.Int32
+	progress atomic.Int32
+}
+
+func (m *testMessage) Ack(context.Context) error                         { m.acks.Add(1); return nil }
+func (m *testMessage) NakWithDelay(context.Context, time.Duration) error { m.naks.Add(1); return nil }
+func (m *testMessage) MessageString() (string, error)                    { return "{}", nil }
+func (m *testMessage) MessageMap() (map[string]any, error)               { return map[string]any{}, nil }
+func (m *testMessage) Subject() string                                   { return "test" }
+func (m *testMessage) InProgress() error                                 { m.progress.Add(1); return nil }
+
+func (m *testMessage) MessageRaw() ([]byte, error) {
+	if m.raw != nil {
+		return m.raw, nil
+	}
+	return []byte("{}"), nil
+}
+
+// testConfig returns the configuration of a new processor, flushing only on demand and on stop
+func testConfig(t *testing.T) *TableConfig {
+	t.Helper()
+
+	config := DefaultTableConfig()
+	config.ProcessorID = uuid.NewString()
+	config.BatchSize = nil
+	config.BatchWindowTTL = nil
+	config.IncludeTimestamp = nil
+	config.tableName = "test_" + config.ProcessorID
+	config.version = "v1"
+
+	t.Cleanup(func() {
+		writerCache.evict(config.ProcessorID)
+	})
+	return config
+}
+
+// writtenRows returns the rows written by the writers of a processor
+func writtenRows(processorID string) []models.Data {
+	testRows.Lock()
+	defer testRows.Unlock()
+	return append([]models.Data(nil), testRows.byProcessor[processorID]...)
+}
+
+func TestEvictionRacingAddRecordsWritesEveryRecordOnce(t *testing.T) {
+	t.Run("buffered", func(t *testing.T) {
+		testEvictionRacingAddRecords(t, testConfig(t))
+	})
+
+	// records beyond the first spill to the spool of the processor, which the evicted writer still owns while it
+	// drains
+	t.Run("spilled", func(t *testing.T) {
+		config := testConfig(t)
+		policy, maxRecords := BackpressureSpill, int64(1)
+		config.Backpressure = &policy
+		config.MaxBufferedRecords = &maxRecords
+		testEvictionRacingAddRecords(t, config)
+	})
+}
+
+// testEvictionRacingAddRecords adds records from concurrent callers while the writer of the processor is evicted over
+// and over, every message must be acked once and every record written once
+func testEvictionRacingAddRecords(t *testing.T, config *TableConfig) {
+	const adders, messagesPerAdder = 8, 50
+
+	done := make(chan struct{})
+	var evictions sync.WaitGroup
+	evictions.Add(1)
+	go func() {
+		defer evictions.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_ = EvictWriter(config.ProcessorID) // not found while no writer is cached
+			writerCache.cleanup()
+		}
+	}()
+
+	messages := make([]*testMessage, adders*messagesPerAdder)
+	var adds sync.WaitGroup
+	for a := 0; a < adders; a++ {
+		adds.Add(1)
+		go func() {
+			defer adds.Done()
+			for i := a * messagesPerAdder; i < (a+1)*messagesPerAdder; i++ {
+				messages[i] = &testMessage{}
+				records := []models.Data{{"id": float64(i)}}
+				if err := AddRecords(config.ProcessorID, config, messages[i], "route", records, 16); err != nil {
+					t.Errorf("failed to add message %d: %v", i, err)
+				}
+			}
+		}()
+	}
+	adds.Wait()
+	close(done)
+	evictions.Wait()
+
+	// replay the records left in the spool by the evicted writers, and drain the last writer
+	for {
+		writer, err := GetBatchWriter(config.ProcessorID, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		info := writer.Info()
+		writer.Release()
+		if info.PendingRecords == 0 && info.Buffer.SpooledBytes == 0 {
+			break
+		}
+	}
+	writerCache.evict(config.ProcessorID)
+
+	for i, msg := range messages {
+		if acks, naks := msg.acks.Load(), msg.naks.Load(); acks != 1 || naks != 0 {
+			t.Errorf("message %d acked %d and nacked %d times, want acked once", i, acks, naks)
+		}
+	}
+
+	seen := make(map[float64]int)
+	for _, row := range writtenRows(config.ProcessorID) {
+		seen[row["id"].(float64)]++
+	}
+	for i := range messages {
+		if seen[float64(i)] != 1 {
+			t.Errorf("record %d written %d times, want once", i, seen[float64(i)])
+		}
+	}
+}
+
+func TestAddOnStoppedWriterUsesFreshWriter(t *testing.T) {
+	config := testConfig(t)
+
+	writer, err := GetBatchWriter(config.ProcessorID, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Release()
+	if err = EvictWriter(config.ProcessorID); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &testMessage{}
+	records := []models.Data{{"id": float64(1)}}
+	if err = writer.Add(msg, "route", records, 16); !errors.Is(err, ErrWriterClosed) {
+		t.Fatalf("Add on a stopped writer returned %v, want ErrWriterClosed", err)
+	}
+	if msg.acks.Load() != 0 || msg.naks.Load() != 0 {
+		t.Fatal("a stopped writer settled a message it refused")
+	}
+
+	if err = AddRecords(config.ProcessorID, config, msg, "route", records, 16); err != nil {
+		t.Fatal(err)
+	}
+	fresh, exists := cachedWriter(config.ProcessorID)
+	if !exists || fresh == writer {
+		t.Fatal("records were not added to a fresh writer")
+	}
+
+	if err = EvictWriter(config.ProcessorID); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(writtenRows(config.ProcessorID)); got != 1 || msg.acks.Load() != 1 {
+		t.Errorf("wrote %d rows and acked %d times, want the record written and acked once", got, msg.acks.Load())
+	}
+}
+
+func TestStopFlushesPendingRecords(t *testing.T) {
+	config := testConfig(t)
+
+	writer, err := GetBatchWriter(config.ProcessorID, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &testMessage{}
+	if err = writer.Add(msg, "route", []models.Data{{"id": float64(1)}, {"id": float64(2)}}, 32); err != nil {
+		t.Fatal(err)
+	}
+	writer.Release()
+
+	// time based flushing is disabled, only stopping the writer writes the batch
+	if got := len(writtenRows(config.ProcessorID)); got != 0 {
+		t.Fatalf("wrote %d rows before stopping, want none", got)
+	}
+	buffered := writerBufferedRecords.WithLabelValues(metricSeries.labels(config.ProcessorID, config.Table())...)
+	if got := testutil.ToFloat64(buffered); got != 2 {
+		t.Errorf("buffered records gauge is %v before stopping, want 2", got)
+	}
+
+	if err = EvictWriter(config.ProcessorID); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(writtenRows(config.ProcessorID)); got != 2 {
+		t.Errorf("wrote %d rows on stop, want 2", got)
+	}
+	if msg.acks.Load() != 1 {
+		t.Errorf("message acked %d times on stop, want once", msg.acks.Load())
+	}
+	if got := testutil.ToFloat64(buffered); got != 0 {
+		t.Errorf("buffered records gauge is %v after stopping, want 0", got)
+	}
+
+	// stopping again has no effect
+	writer.Stop()
+	if msg.acks.Load() != 1 || len(writtenRows(config.ProcessorID)) != 2 {
+		t.Error("stopping again wrote or acked the batch again")
+	}
+}
+
+func TestLeasedWriterIsNotEvicted(t *testing.T) {
+	config := testConfig(t)
+
+	first, err := GetBatchWriter(config.ProcessorID, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := GetBatchWriter(config.ProcessorID, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatal("leases returned different writers for the same processor")
+	}
+	if leases := first.Info().Leases; leases != 2 {
+		t.Fatalf("writer holds %d leases, want 2", leases)
+	}
+
+	idle := func() {
+		first.lastUsed.Store(time.Now().Add(-2 * maxIdleTime).UnixNano())
+	}
+
+	idle()
+	first.Release()
+	writerCache.cleanup()
+	if _, exists := cachedWriter(config.ProcessorID); !exists {
+		t.Fatal("cleanup evicted a leased writer")
+	}
+
+	second.Release()
+	if first.Leased() {
+		t.Fatal("writer is still leased after every lease was released")
+	}
+	writerCache.cleanup()
+	if _, exists := cachedWriter(config.ProcessorID); exists {
+		t.Fatal("cleanup kept an idle writer without leases")
+	}
+
+	if err = first.Add(&testMessage{}, "route", []models.Data{{"id": float64(1)}}, 16); !errors.Is(err, ErrWriterClosed) {
+		t.Errorf("Add on an evicted writer returned %v, want ErrWriterClosed", err)
+	}
+}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/utils"
+)
+
+// overflowLabel replaces the processor and table labels once the series limit is reached
+const overflowLabel = "other"
+
+var (
+	// Distinct processor and table label pairs exported, further pairs are aggregated under overflowLabel
+	metricsMaxSeries = utils.Int64FromEnvWithDefault("METRICS_MAX_SERIES", 500)
+
+	metricSeries = newSeriesGuard(metricsMaxSeries)
+)
+
+var (
+	messagesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "state_tables_messages_received_total",
+		Help: "Messages received by the route subscriber.",
+	})
+
+	recordsAdded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "state_tables_records_added_total",
+		Help: "Records accepted into a batch writer.",
+	}, []string{"processor_id", "table"})
+
+	batchSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "state_tables_batch_size_records",
+		Help:    "Records in a batch when it is flushed.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 9), // 1 to 65536
+	}, []string{"processor_id", "table"})
+
+	flushDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "state_tables_flush_duration_seconds",
+		Help:    "Time taken to flush a batch, including retries.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14), // 5ms to 40s
+	}, []string{"processor_id", "table"})
+
+	flushErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "state_tables_flush_errors_total",
+		Help: "Batches that failed to flush.",
+	}, []string{"processor_id", "table"})
+
+	ddlOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "state_tables_ddl_operations_total",
+		Help: "Schema changes issued against state tables, by operation and result.",
+	}, []string{"operation", "result"})
+
+	publishFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "state_tables_publish_failures_total",
+		Help: "Messages that failed to publish, by route.",
+	}, []string{"route"})
+
+	writerBufferedRecords = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "state_tables_writer_buffered_records",
+		Help: "Records buffered in memory by a batch writer.",
+	}, []string{"processor_id", "table"})
+
+	writerBufferedBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "state_tables_writer_buffered_bytes",
+		Help: "Approximate bytes buffered in memory by a batch writer.",
+	}, []string{"processor_id", "table"})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "state_tables_active_writers",
+		Help: "Batch writers in the writer cache.",
+	}, func() float64 {
+		writerCache.mu.RLock()
+		defer writerCache.mu.RUnlock()
+		return float64(len(writerCache.writers))
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "state_tables_buffered_records",
+		Help: "Records buffered in memory across every writer.",
+	}, func() float64 {
+		return float64(GlobalBufferStats().Records)
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "state_tables_buffered_bytes",
+		Help: "Approximate bytes buffered in memory across every writer.",
+	}, func() float64 {
+		return float64(GlobalBufferStats().Bytes)
+	})
+)
+
+// seriesGuard bounds the number of distinct processor and table label pairs, such that a large or churning set of
+// processors cannot grow the exported series without limit
+type seriesGuard struct {
+	mu     sync.Mutex
+	max    int64
+	series map[[2]string]struct{}
+}
+
+// newSeriesGuard creates a guard admitting up to max label pairs, a max of zero or less is unbounded
+func newSeriesGuard(max int64) *seriesGuard {
+	return &seriesGuard{max: max, series: make(map[[2]string]struct{})}
+}
+
+// labels returns the label values for the processor and table, overflowLabel for both once the limit is reached
+// and the pair was not admitted before
+func (g *seriesGuard) labels(processorID string, table string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := [2]string{processorID, table}
+	if _, exists := g.series[key]; !exists {
+		if g.max > 0 && int64(len(g.series)) >= g.max {
+			return []string{overflowLabel, overflowLabel}
+		}
+		g.series[key] = struct{}{}
+	}
+	return []string{processorID, table}
+}
+
+// observeRecordsAdded counts the records accepted into the batch writer of a processor
+func observeRecordsAdded(processorID string, table string, records int) {
+	recordsAdded.WithLabelValues(metricSeries.labels(processorID, table)...).Add(float64(records))
+}
+
+// observeFlush records the size, duration and outcome of a flushed batch
+func observeFlush(processorID string, table string, records int, duration time.Duration, err error) {
+	labels := metricSeries.labels(processorID, table)
+	batchSize.WithLabelValues(labels...).Observe(float64(records))
+	flushDuration.WithLabelValues(labels...).Observe(duration.Seconds())
+	if err != nil {
+		flushErrors.WithLabelValues(labels...).Inc()
+	}
+}
+
+// observeBuffered adjusts the records and bytes buffered by the batch writer of a processor. The gauges are adjusted
+// rather than set, such that the writers aggregated under overflowLabel add up
+func observeBuffered(processorID string, table string, records int64, bytes int64) {
+	labels := metricSeries.labels(processorID, table)
+	writerBufferedRecords.WithLabelValues(labels...).Add(float64(records))
+	writerBufferedBytes.WithLabelValues(labels...).Add(float64(bytes))
+}
+
+// observeDDL counts a schema change by its outcome
+func observeDDL(operation string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	ddlOperations.WithLabelValues(operation, result).Inc()
+}
@@ -2,12 +2,37 @@ package handler
 
 import (
 	"context"
-	"fmt"
 	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
 	"github.com/quantumwake/alethic-ism-core-go/pkg/repository/processor"
 	"log"
+	"time"
 )
 
+// MonitorFlushSummary is the type of the monitor message reporting the outcome of a flush
+const MonitorFlushSummary models.MessageType = "state_table_flush"
+
+// RouteFlushSummary is the data of the status published for a route once its records in a batch are flushed, such
+// that the input volume of a route can be reconciled with the rows written
+type RouteFlushSummary struct {
+	Table           string    `json:"table"`
+	Rows            int       `json:"rows"`    // rows written to the table
+	Records         int       `json:"records"` // records of the route in the batch
+	Bytes           int64     `json:"bytes"`   // approximate bytes of the records, per the size of their messages
+	FirstIngestedAt time.Time `json:"first_ingested_at"`
+	LastIngestedAt  time.Time `json:"last_ingested_at"`
+}
+
+// FlushSummary is the data of the monitor message published once per flushed batch
+type FlushSummary struct {
+	ProcessorID string `json:"processor_id"`
+	Table       string `json:"table"`
+	Rows        int    `json:"rows"`        // rows written to the table
+	Quarantined int    `json:"quarantined"` // records written to the quarantine table
+	Routes      int    `json:"routes"`      // routes with records in the batch
+	DurationMs  int64  `json:"duration_ms"`
+	Retries     int64  `json:"retries"`
+}
+
 func PublishRouteStatus(ctx context.Context, routeID string, status processor.Status, exception string, data interface{}) {
 	monitorMessage := models.MonitorMessage{
 		Type:      models.MonitorProcessorState,
@@ -22,12 +47,14 @@ func PublishRouteStatus(ctx context.Context, routeID string, status processor.St
 	err := monitorRoute.Publish(ctx, monitorMessage)
 	if err != nil {
 		// TODO need to log this error with proper error handling and logging
+		publishFailures.WithLabelValues("monitor").Inc()
 		log.Print("critical error: unable to publish error to monitor route")
 	}
 
 	err = monitorRoute.Flush()
 	if err != nil {
 		// TODO need to log this error with proper error handling and logging
+		publishFailures.WithLabelValues("monitor").Inc()
 		log.Print("critical error: unable to publish error to monitor route")
 	}
 }
@@ -44,18 +71,19 @@ func PublishStateSync(ctx context.Context, routeID string, queryState []models.D
 	err := syncRoute.Publish(ctx, syncMessage)
 	if err != nil {
 		// TODO need to log this error with proper error handling and logging
+		publishFailures.WithLabelValues("sync").Inc()
 		log.Print("critical error: unable to publish error to state sync route")
 	}
 
 	err = syncRoute.Flush()
 	if err != nil {
 		// TODO need to log this error with proper error handling and logging
+		publishFailures.WithLabelValues("sync").Inc()
 		log.Print("critical error: unable to publish error to state sync route")
 	}
 }
 
 func PublishStatusUpdateWithErrorMsg(ctx context.Context, routeID string, dataValue interface{}, err error) {
-	err = fmt.Errorf("error unmarshalling json object: %v", err)
 	monitorMessage := models.MonitorMessage{
 		Type:      models.MonitorProcessorState,
 		RouteID:   routeID,
@@ -64,9 +92,48 @@ func PublishStatusUpdateWithErrorMsg(ctx context.Context, routeID string, dataVa
 		Data:      dataValue,
 	}
 
+	log.Printf("Sending monitor route: %v, status: %v, error: %v\n", routeID, processor.Failed, err)
+
 	err = monitorRoute.Publish(ctx, monitorMessage)
 	if err != nil {
 		// TODO need to log this error with proper error handling and logging
+		publishFailures.WithLabelValues("monitor").Inc()
 		log.Print("Critical error: unable to publish error to monitor route")
 	}
+
+	err = monitorRoute.Flush()
+	if err != nil {
+		// TODO need to log this error with proper error handling and logging
+		publishFailures.WithLabelValues("monitor").Inc()
+		log.Print("Critical error: unable to publish error to monitor route")
+	}
+}
+
+func PublishFlushSummary(ctx context.Context, summary FlushSummary, err error) {
+	monitorMessage := models.MonitorMessage{
+		Type:   MonitorFlushSummary,
+		Status: processor.Completed,
+		Data:   summary,
+	}
+	if err != nil {
+		monitorMessage.Status = processor.Failed
+		monitorMessage.Exception = err.Error()
+	}
+
+	log.Printf("Flushed table: %v, rows: %d, quarantined: %d, duration: %dms, retries: %d, error: %v\n",
+		summary.Table, summary.Rows, summary.Quarantined, summary.DurationMs, summary.Retries, err)
+
+	err = monitorRoute.Publish(ctx, monitorMessage)
+	if err != nil {
+		// TODO need to log this error with proper error handling and logging
+		publishFailures.WithLabelValues("monitor").Inc()
+		log.Print("critical error: unable to publish flush summary to monitor route")
+	}
+
+	err = monitorRoute.Flush()
+	if err != nil {
+		// TODO need to log this error with proper error handling and logging
+		publishFailures.WithLabelValues("monitor").Inc()
+		log.Print("critical error: unable to publish flush summary to monitor route")
+	}
 }
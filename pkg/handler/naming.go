@@ -0,0 +1,238 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
+)
+
+const (
+	maxIdentifierLength = 63 // postgres truncates identifiers longer than this many bytes
+	identifierHashLen   = 8  // hex characters of the hash suffix appended to truncated or colliding identifiers
+)
+
+const (
+	ColumnNamingPreserve  = "preserve"   // keep record keys as they are (default)
+	ColumnNamingSnakeCase = "snake_case" // convert record keys to snake_case
+	ColumnNamingLower     = "lower"      // lower case record keys
+)
+
+// DefaultTableNameTemplate names a table after its processor and configured name
+const DefaultTableNameTemplate = "{processor}_{name}"
+
+// isTableNameSafe reports whether a table name, or a part of one, consists only of letters, digits, underscores and
+// hyphens
+func isTableNameSafe(name string) bool {
+	for _, r := range name {
+		if !(r == '_' || r == '-' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// truncateTableName truncates a table name exceeding the identifier limit, suffixed with a hash of the full name such
+// that names sharing a prefix remain distinct. Names within the limit are kept as they are, such that the tables
+// named before templates were introduced keep their names.
+func truncateTableName(name string) string {
+	if len(name) <= maxIdentifierLength {
+		return name
+	}
+	return truncateBytes(name, maxIdentifierLength-identifierHashLen-1) + "_" + identifierHash(name)
+}
+
+// derivedName names an object derived from a table (quarantine table, index) by suffixing the table name. When the
+// derived name would exceed the identifier limit, the table name is truncated and suffixed with its hash, such that
+// tables sharing a prefix still derive distinct names.
+func derivedName(tableName string, suffix string) string {
+	if len(tableName)+len(suffix) <= maxIdentifierLength {
+		return tableName + suffix
+	}
+	return truncateBytes(tableName, maxIdentifierLength-len(suffix)-identifierHashLen-1) + "_" + identifierHash(tableName) + suffix
+}
+
+// quoteIdent quotes an identifier, escaping embedded double quotes
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// NormalizeColumnName derives the column name for a record key per the naming mode. Names that are empty or exceed
+// the identifier limit are made deterministic and unique by a hash of the original key.
+func NormalizeColumnName(key string, mode string) string {
+	name := key
+	switch mode {
+	case ColumnNamingLower:
+		name = strings.ToLower(key)
+	case ColumnNamingSnakeCase:
+		name = toSnakeCase(key)
+	}
+
+	if name == "" {
+		return "_col_" + identifierHash(key)
+	}
+	return truncateIdentifier(name, key)
+}
+
+// SuffixColumnName derives an alternative column name for a key whose normalized name is taken by another key
+func SuffixColumnName(name string, key string) string {
+	return truncateBytes(name, maxIdentifierLength-identifierHashLen-1) + "_" + identifierHash(key)
+}
+
+// truncateIdentifier truncates a name exceeding the identifier limit, suffixed with a hash of the source it was
+// derived from such that distinct sources sharing a prefix remain distinct
+func truncateIdentifier(name string, source string) string {
+	if len(name) <= maxIdentifierLength {
+		return name
+	}
+	return SuffixColumnName(name, source)
+}
+
+// truncateBytes truncates a string to at most n bytes without splitting a multi-byte character
+func truncateBytes(value string, n int) string {
+	if len(value) <= n {
+		return value
+	}
+	for n > 0 && !utf8.RuneStart(value[n]) {
+		n--
+	}
+	return value[:n]
+}
+
+// identifierHash returns a short, stable hash of a name
+func identifierHash(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])[:identifierHashLen]
+}
+
+// toSnakeCase converts camelCase, PascalCase, kebab-case and space separated words to snake_case, any character
+// other than a letter or digit becomes a separator (leading underscores are kept, e.g. _timestamp)
+func toSnakeCase(key string) string {
+	var b strings.Builder
+	runes := []rune(key)
+	leading := true
+	for i, r := range runes {
+		switch {
+		case r == '_' && leading:
+			b.WriteRune(r)
+			continue
+		case unicode.IsUpper(r):
+			// start a new word on a lower to upper transition, or at the last upper of an acronym (e.g. HTTPServer)
+			if i > 0 && !leading {
+				prev := runes[i-1]
+				nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+				if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+					writeSeparator(&b)
+				}
+			}
+			b.WriteRune(unicode.ToLower(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		default:
+			if !leading {
+				writeSeparator(&b)
+			}
+			continue
+		}
+		leading = false
+	}
+	return strings.TrimRight(b.String(), "_")
+}
+
+// writeSeparator writes a single underscore, collapsing consecutive separators
+func writeSeparator(b *strings.Builder) {
+	if s := b.String(); len(s) > 0 && s[len(s)-1] != '_' {
+		b.WriteByte('_')
+	}
+}
+
+// resolveColumns resolves the column name of each record key not yet known to the writer, loading the names already
+// registered for the table on first use. A key whose normalized name is taken by another key is given a name suffixed
+// with a hash of the key, and every new name is registered in the catalog (must be called with lock held)
+func (bw *BatchWriter) resolveColumns(keys []string) error {
+	if bw.columnNames == nil {
+		mappings, err := FindColumnMappings(bw.tableName)
+		if err != nil {
+			return fmt.Errorf("failed to read column names of table %s: %w", bw.tableName, err)
+		}
+
+		bw.columnNames = make(map[string]string, len(mappings))
+		bw.columnKeys = make(map[string]string, len(mappings))
+		if bw.config.Mode() == WriteModeHistory {
+			// the version columns are maintained by the writer, no record key may take their names
+			for column := range historyColumns {
+				bw.columnKeys[column] = column
+			}
+		}
+		for key, column := range mappings {
+			bw.columnNames[key] = column
+			bw.columnKeys[column] = key
+		}
+	}
+
+	for _, key := range keys {
+		if _, exists := bw.columnNames[key]; exists {
+			continue
+		}
+
+		column, err := bw.registerColumn(key)
+		if err != nil {
+			return fmt.Errorf("failed to resolve column name of key %q in table %s: %w", key, bw.tableName, err)
+		}
+		bw.columnNames[key] = column
+		bw.columnKeys[column] = key
+	}
+	return nil
+}
+
+// registerColumn registers the column name of a record key, the normalized name or else the suffixed name when the
+// normalized name is taken, returning the name registered (must be called with lock held)
+func (bw *BatchWriter) registerColumn(key string) (string, error) {
+	name := NormalizeColumnName(key, bw.config.Naming())
+	for _, candidate := range []string{name, SuffixColumnName(name, key)} {
+		if owner, taken := bw.columnKeys[candidate]; taken && owner != key {
+			continue
+		}
+
+		// another instance may have registered the key, or taken the name for another key, in the meantime
+		column, err := RegisterColumnMapping(bw.tableName, key, candidate)
+		if err != nil {
+			return "", err
+		}
+		if column != "" {
+			return column, nil
+		}
+	}
+	return "", fmt.Errorf("%w: column names %s and its suffixed form are taken by other keys", ErrSchemaConflict, name)
+}
+
+// column returns the column name of a record key, names not derived from record keys are returned as is (must be
+// called with lock held)
+func (bw *BatchWriter) column(key string) string {
+	if column, exists := bw.columnNames[key]; exists {
+		return column
+	}
+	return key
+}
+
+// columnList returns the column names of the record keys (must be called with lock held)
+func (bw *BatchWriter) columnList(keys []string) []string {
+	columns := make([]string, len(keys))
+	for i, key := range keys {
+		columns[i] = bw.column(key)
+	}
+	return columns
+}
+
+// toRow returns the record keyed by column name (must be called with lock held)
+func (bw *BatchWriter) toRow(record models.Data) models.Data {
+	row := make(models.Data, len(record))
+	for key, value := range record {
+		row[bw.column(key)] = value
+	}
+	return row
+}
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatTableNameKeepsNamesWithinIdentifierLimit(t *testing.T) {
+	processorID := "3f1c2a9e-5b7d-4e8f-9a0b-1c2d3e4f5a6b"
+
+	// {processor}_{name} with a 26 character name is exactly 63 bytes, the name postgres always accepted
+	name := strings.Repeat("n", 26)
+	table, err := FormatTableName(DefaultTableNameTemplate, "", processorID, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := processorID + "_" + name; table != want {
+		t.Errorf("table name = %q, want %q", table, want)
+	}
+
+	// one byte more is truncated and hashed, distinct from a name sharing the prefix
+	long, err := FormatTableName(DefaultTableNameTemplate, "", processorID, name+"a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := FormatTableName(DefaultTableNameTemplate, "", processorID, name+"b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(long) > maxIdentifierLength || long == other {
+		t.Errorf("table names %q and %q must be distinct and within %d bytes", long, other, maxIdentifierLength)
+	}
+}
+
+func TestFormatTableNameDropsSeparatorsOfEmptyPlaceholders(t *testing.T) {
+	for _, test := range []struct {
+		template, project, name, want string
+	}{
+		{"{processor}_{name}", "", "orders", "pid_orders"},
+		{"{processor}_{name}", "", "", "pid"},
+		{"{processor}_{name}", "", "_orders_", "pid__orders_"}, // separators of the configured name are kept
+		{"{processor}_{name}", "", "-", "pid_-"},
+		{"{project}_{processor}_{name}", "", "orders", "pid_orders"},
+		{"{project}_{processor}_{name}", "proj", "", "proj_pid"},
+		{"{processor}_{project}_{name}", "", "orders", "pid_orders"},
+		{"state_{name}", "", "", "state"},
+	} {
+		got, err := FormatTableName(test.template, test.project, "pid", test.name)
+		if err != nil {
+			t.Errorf("FormatTableName(%q, %q, %q) failed: %v", test.template, test.project, test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("FormatTableName(%q, %q, %q) = %q, want %q", test.template, test.project, test.name, got, test.want)
+		}
+	}
+}
+
+func TestDerivedNameFitsIdentifierLimit(t *testing.T) {
+	short := "orders"
+	if got := derivedName(short, quarantineSuffix); got != short+quarantineSuffix {
+		t.Errorf("derivedName(%q) = %q, want the suffixed table name", short, got)
+	}
+
+	a := strings.Repeat("t", maxIdentifierLength-1) + "a"
+	b := strings.Repeat("t", maxIdentifierLength-1) + "b"
+	derivedA, derivedB := derivedName(a, quarantineSuffix), derivedName(b, quarantineSuffix)
+	if len(derivedA) > maxIdentifierLength || !strings.HasSuffix(derivedA, quarantineSuffix) {
+		t.Errorf("derivedName(%q) = %q, want at most %d bytes ending in %s", a, derivedA, maxIdentifierLength, quarantineSuffix)
+	}
+	if derivedA == derivedB {
+		t.Errorf("tables %q and %q derive the same name %q", a, b, derivedA)
+	}
+}
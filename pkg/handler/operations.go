@@ -0,0 +1,357 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/utils"
+)
+
+var (
+	// Transient errors, the message is redelivered
+	ErrProcessorPaused = errors.New("processor is paused")
+)
+
+var (
+	ErrWriterNotFound       = errors.New("writer not found")
+	ErrConfirmationRequired = errors.New("confirmation required")
+)
+
+var (
+	// Rows returned by an export at most
+	exportMaxRows = utils.Int64FromEnvWithDefault("EXPORT_MAX_ROWS", 10000)
+)
+
+var (
+	pausedMu sync.RWMutex
+	paused   = make(map[string]time.Time) // Processors whose ingestion is paused, with when they were paused
+)
+
+// WriterInfo is a snapshot of a cached batch writer, along with the configuration in effect
+type WriterInfo struct {
+	ProcessorID     string       `json:"processor_id"`
+	Table           string       `json:"table"`
+	PendingRecords  int          `json:"pending_records"`
+	PendingMessages int          `json:"pending_messages"`
+	Buffer          BufferStats  `json:"buffer"`
+	LastFlush       time.Time    `json:"last_flush"`
+	LastUsed        time.Time    `json:"last_used"`
+	Leases          int32        `json:"leases"`
+	Paused          bool         `json:"paused"`
+	Config          *TableConfig `json:"config"`
+}
+
+// ListWriters returns a snapshot of every cached writer, ordered by processor id
+func ListWriters() []WriterInfo {
+	writers := cachedWriters()
+	infos := make([]WriterInfo, 0, len(writers))
+	for _, writer := range writers {
+		infos = append(infos, writerInfo(writer))
+	}
+	slices.SortFunc(infos, func(a, b WriterInfo) int {
+		return strings.Compare(a.ProcessorID, b.ProcessorID)
+	})
+	return infos
+}
+
+// FindWriter returns a snapshot of the cached writer of a processor
+func FindWriter(processorID string) (WriterInfo, error) {
+	writer, ok := cachedWriter(processorID)
+	if !ok {
+		return WriterInfo{}, fmt.Errorf("%w: %s", ErrWriterNotFound, processorID)
+	}
+	return writerInfo(writer), nil
+}
+
+// FlushWriter flushes the pending batch of the cached writer of a processor
+func FlushWriter(processorID string) error {
+	writer, ok := cachedWriter(processorID)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrWriterNotFound, processorID)
+	}
+
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush table %s: %w", writer.Table(), err)
+	}
+	return nil
+}
+
+// FlushAllWriters flushes the pending batch of every cached writer, returning the errors of the writers that failed
+func FlushAllWriters() error {
+	var errs []error
+	for _, writer := range cachedWriters() {
+		if err := writer.Flush(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to flush table %s: %w", writer.Table(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// EvictWriter removes the cached writer of a processor and stops it, flushing its pending batch. The next message
+// of the processor creates a fresh writer.
+func EvictWriter(processorID string) error {
+	if !writerCache.evict(processorID) {
+		return fmt.Errorf("%w: %s", ErrWriterNotFound, processorID)
+	}
+	return nil
+}
+
+// PauseProcessor pauses the ingestion of a processor on this instance, its messages are redelivered with backoff
+// until it is resumed. The pending batch is still flushed.
+func PauseProcessor(processorID string) {
+	pausedMu.Lock()
+	defer pausedMu.Unlock()
+	if _, exists := paused[processorID]; !exists {
+		paused[processorID] = time.Now()
+	}
+}
+
+// ResumeProcessor resumes the ingestion of a paused processor, reporting whether it was paused
+func ResumeProcessor(processorID string) bool {
+	pausedMu.Lock()
+	defer pausedMu.Unlock()
+	_, exists := paused[processorID]
+	delete(paused, processorID)
+	return exists
+}
+
+// IsPaused reports whether the ingestion of a processor is paused
+func IsPaused(processorID string) bool {
+	pausedMu.RLock()
+	defer pausedMu.RUnlock()
+	_, exists := paused[processorID]
+	return exists
+}
+
+// PausedProcessors returns the paused processors, with when they were paused
+func PausedProcessors() map[string]time.Time {
+	pausedMu.RLock()
+	defer pausedMu.RUnlock()
+
+	processors := make(map[string]time.Time, len(paused))
+	for processorID, since := range paused {
+		processors[processorID] = since
+	}
+	return processors
+}
+
+// writerInfo returns a snapshot of the writer, along with whether its processor is paused
+func writerInfo(writer *BatchWriter) WriterInfo {
+	info := writer.Info()
+	info.Paused = IsPaused(info.ProcessorID)
+	return info
+}
+
+// TableSnapshot is an export of the rows of a table, keyed by record key
+type TableSnapshot struct {
+	Table     string        `json:"table"`
+	Rows      []models.Data `json:"rows"`
+	Truncated bool          `json:"truncated"` // whether the table holds more rows than were exported
+}
+
+// TruncateProcessorTable removes every row from the table of a processor, once its pending batch is flushed. The
+// confirmation must name the table.
+func TruncateProcessorTable(processorID string, confirm string) error {
+	return withWriter(processorID, func(writer *BatchWriter) error {
+		return writer.Truncate(confirm)
+	})
+}
+
+// DropProcessorTable drops the table of a processor and its quarantine table, once its pending batch is flushed.
+// The confirmation must name the table. The table is created again by the next flush.
+func DropProcessorTable(processorID string, confirm string) error {
+	return withWriter(processorID, func(writer *BatchWriter) error {
+		return writer.Drop(confirm)
+	})
+}
+
+// RebuildProcessorSchema reapplies the configuration of a processor to its table, returning the resulting columns
+func RebuildProcessorSchema(processorID string) (map[string]ColumnType, error) {
+	var columns map[string]ColumnType
+	err := withWriter(processorID, func(writer *BatchWriter) (err error) {
+		columns, err = writer.RebuildSchema()
+		return err
+	})
+	return columns, err
+}
+
+// ExportProcessorTable returns up to limit rows of the table of a processor, bounded by EXPORT_MAX_ROWS
+func ExportProcessorTable(processorID string, limit int) (TableSnapshot, error) {
+	config, err := getProcessorConfig(processorID)
+	if err != nil {
+		return TableSnapshot{}, err
+	}
+
+	if limit <= 0 || int64(limit) > exportMaxRows {
+		limit = int(exportMaxRows)
+	}
+
+	rows, err := SelectRows(config.Table(), limit+1)
+	if err != nil {
+		return TableSnapshot{}, fmt.Errorf("failed to export table %s: %w", config.Table(), err)
+	}
+
+	keys, err := FindColumnMappings(config.Table())
+	if err != nil {
+		return TableSnapshot{}, fmt.Errorf("failed to read column names of table %s: %w", config.Table(), err)
+	}
+
+	snapshot := TableSnapshot{Table: config.Table(), Rows: toRecords(rows, keys), Truncated: len(rows) > limit}
+	if snapshot.Truncated {
+		snapshot.Rows = snapshot.Rows[:limit]
+	}
+	return snapshot, nil
+}
+
+// withWriter runs the operation on the writer of a processor under a lease, creating the writer from the current
+// configuration when it is not cached
+func withWriter(processorID string, operation func(writer *BatchWriter) error) error {
+	config, err := getProcessorConfig(processorID)
+	if err != nil {
+		return err
+	}
+
+	writer, err := GetBatchWriter(processorID, config)
+	if err != nil {
+		return err
+	}
+	defer writer.Release()
+	return operation(writer)
+}
+
+// toRecords keys the rows by record key per the catalog mappings of each key to its column, columns not derived
+// from a record key keep their name
+func toRecords(rows []models.Data, mappings map[string]string) []models.Data {
+	keys := make(map[string]string, len(mappings))
+	for key, column := range mappings {
+		keys[column] = key
+	}
+
+	records := make([]models.Data, len(rows))
+	for i, row := range rows {
+		record := make(models.Data, len(row))
+		for column, value := range row {
+			if key, exists := keys[column]; exists {
+				record[key] = value
+			} else {
+				record[column] = value
+			}
+		}
+		records[i] = record
+	}
+	return records
+}
+
+// Truncate removes every row from the table, once the pending batch is flushed and the spooled records discarded.
+// The confirmation must name the table.
+func (bw *BatchWriter) Truncate(confirm string) error {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	if err := bw.confirm(confirm); err != nil {
+		return err
+	}
+	if err := bw.flush(); err != nil {
+		return fmt.Errorf("failed to flush table %s before truncating: %w", bw.tableName, err)
+	}
+	if err := bw.discardSpooled(); err != nil {
+		return err
+	}
+	if err := TruncateTable(bw.tableName); err != nil {
+		return fmt.Errorf("failed to truncate table %s: %w", bw.tableName, err)
+	}
+	log.Printf("truncated table %s\n", bw.tableName)
+	return nil
+}
+
+// Drop drops the table and its quarantine table along with its column names, once the pending batch is flushed and
+// the spooled records discarded, such that they are not replayed into a new table. The confirmation must name the
+// table.
+func (bw *BatchWriter) Drop(confirm string) error {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	if err := bw.confirm(confirm); err != nil {
+		return err
+	}
+	if err := bw.flush(); err != nil {
+		return fmt.Errorf("failed to flush table %s before dropping: %w", bw.tableName, err)
+	}
+	if err := bw.discardSpooled(); err != nil {
+		return err
+	}
+
+	for _, table := range []string{bw.tableName, QuarantineTableName(bw.tableName)} {
+		if err := DropTable(table); err != nil {
+			return fmt.Errorf("failed to drop table %s: %w", table, err)
+		}
+	}
+	if err := DeleteColumnMappings(bw.tableName); err != nil {
+		return fmt.Errorf("failed to delete column names of table %s: %w", bw.tableName, err)
+	}
+
+	bw.resetTableState()
+	log.Printf("dropped table %s\n", bw.tableName)
+	return nil
+}
+
+// RebuildSchema reads the table from the database again and reapplies the configuration to it: declared and missing
+// columns are added and the key indexes created. A table with an inferred schema that does not exist yet is left to
+// be created by the next flush. It returns the resulting columns.
+func (bw *BatchWriter) RebuildSchema() (map[string]ColumnType, error) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	if err := bw.flush(); err != nil {
+		return nil, fmt.Errorf("failed to flush table %s before rebuilding its schema: %w", bw.tableName, err)
+	}
+	bw.resetTableState()
+
+	existing, err := FindTableColumns(bw.tableName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read columns of table %s: %w", bw.tableName, err)
+	}
+	if len(existing) == 0 && !bw.config.HasSchema() {
+		return existing, nil
+	}
+
+	if err = bw.resolveColumns(bw.config.ColumnKeys()); err != nil {
+		return nil, err
+	}
+	if err = bw.ensureTable(nil); err != nil {
+		return nil, err
+	}
+	log.Printf("rebuilt schema of table %s\n", bw.tableName)
+	return FindTableColumns(bw.tableName)
+}
+
+// discardSpooled discards the records left in the spool by a flush, including those it loaded into the batch. They
+// were ingested before the table is truncated or dropped, so they would have been removed along with the rows had
+// the buffer held them (must be called with lock held after a successful flush)
+func (bw *BatchWriter) discardSpooled() error {
+	backlog := bw.spool.backlog()
+	if backlog == 0 {
+		return nil
+	}
+
+	bw.reset()
+	if err := bw.spool.discard(); err != nil {
+		return fmt.Errorf("failed to discard spooled records of table %s: %w", bw.tableName, err)
+	}
+	log.Printf("discarded %d bytes of spooled records of table %s\n", backlog, bw.tableName)
+	return nil
+}
+
+// confirm returns ErrConfirmationRequired unless the confirmation names the table (must be called with lock held)
+func (bw *BatchWriter) confirm(confirm string) error {
+	if confirm != bw.tableName {
+		return fmt.Errorf("%w: confirm with the table name %s", ErrConfirmationRequired, bw.tableName)
+	}
+	return nil
+}
@@ -0,0 +1,448 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/utils"
+)
+
+const (
+	FilterEq      = "eq"
+	FilterNe      = "ne"
+	FilterLt      = "lt"
+	FilterLte     = "lte"
+	FilterGt      = "gt"
+	FilterGte     = "gte"
+	FilterLike    = "like"     // sql LIKE pattern, matched against the value as text
+	FilterILike   = "ilike"    // case insensitive LIKE
+	FilterIn      = "in"       // value is a list
+	FilterIsNull  = "is_null"  // no value
+	FilterNotNull = "not_null" // no value
+)
+
+// maxFilterValues bounds the values of an in filter
+const maxFilterValues = 1000
+
+// Columns selected alongside the projection to build the cursor, removed from the rows returned
+const (
+	querySortAlias = "_query_sort_"
+	queryCTIDAlias = "_query_ctid"
+)
+
+var (
+	// Bearer token required by the HTTP query API, the API is disabled when empty
+	queryAPIToken = utils.StringFromEnvWithDefault("QUERY_API_TOKEN", "")
+
+	// Rows returned by a query when no limit is given, and at most
+	queryDefaultLimit = utils.Int64FromEnvWithDefault("QUERY_DEFAULT_LIMIT", 100)
+	queryMaxLimit     = utils.Int64FromEnvWithDefault("QUERY_MAX_LIMIT", 1000)
+)
+
+var (
+	ErrInvalidQuery = errors.New("invalid query")
+)
+
+// filterOperators are the comparison operators of the filters comparing a column with a single value
+var filterOperators = map[string]string{
+	FilterEq:  "=",
+	FilterNe:  "<>",
+	FilterLt:  "<",
+	FilterLte: "<=",
+	FilterGt:  ">",
+	FilterGte: ">=",
+}
+
+// QueryRequest reads rows of the table of a processor. Columns are named by record key, or by column name for the
+// columns not derived from a record key (e.g. _valid_from).
+type QueryRequest struct {
+	ProcessorID string        `json:"processor_id"`
+	Columns     []string      `json:"columns,omitempty"` // columns returned, every column when empty
+	Filters     []QueryFilter `json:"filters,omitempty"` // conditions every row returned matches
+	Sort        []QuerySort   `json:"sort,omitempty"`    // order of the rows, ties are broken by the key columns
+	Limit       int           `json:"limit,omitempty"`   // rows returned, bounded by QUERY_MAX_LIMIT
+	Cursor      string        `json:"cursor,omitempty"`  // next_cursor of the previous page, with the same sort
+}
+
+// QueryFilter compares a column with a value, see the Filter constants
+type QueryFilter struct {
+	Column string `json:"column"`
+	Op     string `json:"op"`
+	Value  any    `json:"value,omitempty"`
+}
+
+// QuerySort orders the rows by a column, nulls last
+type QuerySort struct {
+	Column string `json:"column"`
+	Desc   bool   `json:"desc,omitempty"`
+}
+
+// QueryResult is a page of rows keyed by record key, next_cursor is set when more rows follow
+type QueryResult struct {
+	Table      string        `json:"table"`
+	Rows       []models.Data `json:"rows"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// queryCursor is the position after the last row of a page: its values of the columns ordering the rows and its
+// physical location
+type queryCursor struct {
+	Sort   string `json:"s"` // hash of the order the cursor was produced by
+	Values []any  `json:"v"`
+	CTID   string `json:"c"`
+}
+
+// tableColumns resolves the column names a query refers to against the columns of a table
+type tableColumns struct {
+	types map[string]ColumnType // columns of the table, with their types
+	names map[string]string     // column name of each record key, per the catalog
+}
+
+// column returns the column a query refers to by record key or column name, failing for columns not in the table
+func (t tableColumns) column(name string) (string, error) {
+	column := name
+	if mapped, exists := t.names[name]; exists {
+		column = mapped
+	}
+	if _, exists := t.types[column]; !exists {
+		return "", fmt.Errorf("%w: unknown column %q", ErrInvalidQuery, name)
+	}
+	return column, nil
+}
+
+// QueryTable reads a page of rows of the table of a processor
+func QueryTable(request QueryRequest) (QueryResult, error) {
+	config, err := getProcessorConfig(request.ProcessorID)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	table := config.Table()
+
+	types, err := FindTableColumns(table)
+	if err != nil {
+		return QueryResult{}, fmt.Errorf("failed to read columns of table %s: %w", table, err)
+	}
+	if len(types) == 0 {
+		return QueryResult{Table: table, Rows: []models.Data{}}, nil
+	}
+
+	names, err := FindColumnMappings(table)
+	if err != nil {
+		return QueryResult{}, fmt.Errorf("failed to read column names of table %s: %w", table, err)
+	}
+
+	limit := int(queryDefaultLimit)
+	if request.Limit > 0 {
+		limit = min(request.Limit, int(queryMaxLimit))
+	}
+
+	columns := tableColumns{types: types, names: names}
+	order, err := queryOrder(columns, request.Sort, tiebreakColumns(config, columns))
+	if err != nil {
+		return QueryResult{}, err
+	}
+	query, args, err := buildQuery(table, columns, request, order, limit)
+	if err != nil {
+		return QueryResult{}, err
+	}
+
+	db, err := GetDB()
+	if err != nil {
+		return QueryResult{}, err
+	}
+	sqlRows, err := querySQL(db, query, args...)
+	if err != nil {
+		return QueryResult{}, fmt.Errorf("failed to query table %s: %w", table, err)
+	}
+	rows, err := scanRows(sqlRows)
+	if err != nil {
+		return QueryResult{}, fmt.Errorf("failed to query table %s: %w", table, err)
+	}
+
+	result := QueryResult{Table: table}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		if result.NextCursor, err = encodeCursor(order, rows[limit-1]); err != nil {
+			return QueryResult{}, err
+		}
+	}
+	for _, row := range rows {
+		for i := range order {
+			delete(row, fmt.Sprintf("%s%d", querySortAlias, i))
+		}
+		delete(row, queryCTIDAlias)
+	}
+	result.Rows = toRecords(rows, names)
+	return result, nil
+}
+
+// tiebreakColumns returns the columns breaking ties between rows with the same sort values, ahead of their physical
+// location which changes when a row is updated in place: the key columns, along with the version start of history
+// tables. Tables without keys are only ever appended to, such that their rows keep their physical location.
+func tiebreakColumns(config *TableConfig, columns tableColumns) []string {
+	keys := config.Keys()
+	if config.Mode() == WriteModeHistory {
+		keys = append(append([]string{}, keys...), columnValidFrom)
+	}
+
+	tiebreak := make([]string, 0, len(keys))
+	for _, key := range keys {
+		column, err := columns.column(key)
+		if err != nil || columns.types[column] == ColumnJSONB {
+			return nil // the table has not caught up with the configuration
+		}
+		tiebreak = append(tiebreak, column)
+	}
+	return tiebreak
+}
+
+// queryOrder resolves the columns ordering the rows: the requested sort followed by the tiebreak columns not sorted
+// on, in ascending order
+func queryOrder(columns tableColumns, sorts []QuerySort, tiebreak []string) ([]QuerySort, error) {
+	order := make([]QuerySort, 0, len(sorts)+len(tiebreak))
+	sorted := make(map[string]bool, len(sorts))
+	for _, sort := range sorts {
+		column, err := columns.column(sort.Column)
+		if err != nil {
+			return nil, err
+		}
+		if columns.types[column] == ColumnJSONB {
+			return nil, fmt.Errorf("%w: cannot sort by jsonb column %q", ErrInvalidQuery, sort.Column)
+		}
+		order = append(order, QuerySort{Column: column, Desc: sort.Desc})
+		sorted[column] = true
+	}
+	for _, column := range tiebreak {
+		if !sorted[column] {
+			order = append(order, QuerySort{Column: column})
+		}
+	}
+	return order, nil
+}
+
+// buildQuery translates the request into a parameterized query selecting one row past the limit, such that a
+// further page can be detected. The rows are in the given order (see queryOrder), with remaining ties broken by
+// physical location. Every column is validated against the table and quoted, and every value bound as a parameter.
+func buildQuery(table string, columns tableColumns, request QueryRequest, order []QuerySort, limit int) (string, []any, error) {
+	var args []any
+	bind := func(value any) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	// projection, followed by the values ordering each row and its physical location for the cursor
+	projection := []string{"*"}
+	if len(request.Columns) > 0 {
+		projection = projection[:0]
+		for _, name := range request.Columns {
+			column, err := columns.column(name)
+			if err != nil {
+				return "", nil, err
+			}
+			projection = append(projection, quoteIdent(column))
+		}
+	}
+
+	var orderBy []string
+	for i, sort := range order {
+		projection = append(projection, fmt.Sprintf("%s AS %s", quoteIdent(sort.Column), quoteIdent(fmt.Sprintf("%s%d", querySortAlias, i))))
+		orderBy = append(orderBy, quoteIdent(sort.Column)+sortDirection(sort.Desc)+" NULLS LAST")
+	}
+	projection = append(projection, "ctid::text AS "+quoteIdent(queryCTIDAlias))
+	orderBy = append(orderBy, "ctid")
+
+	var conditions []string
+	for _, filter := range request.Filters {
+		column, err := columns.column(filter.Column)
+		if err != nil {
+			return "", nil, err
+		}
+		condition, err := filterCondition(quoteIdent(column), columns.types[column], filter, bind)
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+
+	if request.Cursor != "" {
+		condition, err := cursorCondition(request.Cursor, order, columns.types, bind)
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+
+	query := fmt.Sprintf(`SELECT %s FROM %s`, strings.Join(projection, ", "), quoteIdent(table))
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s LIMIT %s", strings.Join(orderBy, ", "), bind(limit+1))
+	return query, args, nil
+}
+
+// filterCondition renders a filter on the quoted column, binding its values converted to the column type
+func filterCondition(column string, columnType ColumnType, filter QueryFilter, bind func(any) string) (string, error) {
+	value := func(value any) (string, error) {
+		converted, err := ConvertValue(columnType, value)
+		if err != nil {
+			return "", fmt.Errorf("%w: column %s: %v", ErrInvalidQuery, filter.Column, err)
+		}
+		return bind(converted), nil
+	}
+
+	switch op := filter.Op; {
+	case op == FilterIsNull || (op == FilterEq && filter.Value == nil):
+		return column + " IS NULL", nil
+	case op == FilterNotNull || (op == FilterNe && filter.Value == nil):
+		return column + " IS NOT NULL", nil
+	case filterOperators[op] != "":
+		placeholder, err := value(filter.Value)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s %s", column, filterOperators[op], placeholder), nil
+	case op == FilterLike || op == FilterILike:
+		pattern, ok := filter.Value.(string)
+		if !ok {
+			return "", fmt.Errorf("%w: %s filter on column %s requires a string pattern", ErrInvalidQuery, op, filter.Column)
+		}
+		return fmt.Sprintf("CAST(%s AS TEXT) %s %s", column, strings.ToUpper(op), bind(pattern)), nil
+	case op == FilterIn:
+		values, ok := filter.Value.([]any)
+		if !ok || len(values) == 0 || len(values) > maxFilterValues {
+			return "", fmt.Errorf("%w: in filter on column %s requires a list of 1 to %d values", ErrInvalidQuery, filter.Column, maxFilterValues)
+		}
+		placeholders := make([]string, len(values))
+		for i, v := range values {
+			placeholder, err := value(v)
+			if err != nil {
+				return "", err
+			}
+			placeholders[i] = placeholder
+		}
+		return fmt.Sprintf("%s IN (%s)", column, strings.Join(placeholders, ", ")), nil
+	}
+	return "", fmt.Errorf("%w: unknown filter operator %q", ErrInvalidQuery, filter.Op)
+}
+
+// cursorCondition renders the keyset condition selecting the rows after the cursor in the order: rows whose values
+// of the ordering columns follow the cursor's, with remaining ties broken by physical location. Nulls sort last in
+// either direction.
+func cursorCondition(encoded string, order []QuerySort, types map[string]ColumnType, bind func(any) string) (string, error) {
+	cursor, err := decodeCursor(encoded, order)
+	if err != nil {
+		return "", err
+	}
+
+	var alternatives []string
+	var equal []string
+	for i, sort := range order {
+		column := sort.Column
+		quoted := quoteIdent(column)
+		value := cursor.Values[i]
+
+		if value == nil {
+			// nothing sorts after null but other nulls, which are ordered by location
+			equal = append(equal, quoted+" IS NULL")
+			continue
+		}
+
+		converted, err := ConvertValue(types[column], value)
+		if err != nil {
+			return "", fmt.Errorf("%w: invalid cursor: %v", ErrInvalidQuery, err)
+		}
+		placeholder := bind(converted)
+
+		operator := ">"
+		if sort.Desc {
+			operator = "<"
+		}
+		after := fmt.Sprintf("(%s %s %s OR %s IS NULL)", quoted, operator, placeholder, quoted)
+		alternatives = append(alternatives, joinConditions(append(append([]string{}, equal...), after)))
+		equal = append(equal, fmt.Sprintf("%s = %s", quoted, placeholder))
+	}
+	after := fmt.Sprintf("ctid > %s::text::tid", bind(cursor.CTID))
+	alternatives = append(alternatives, joinConditions(append(equal, after)))
+
+	return "(" + strings.Join(alternatives, " OR ") + ")", nil
+}
+
+// joinConditions joins the conditions with AND, parenthesized
+func joinConditions(conditions []string) string {
+	return "(" + strings.Join(conditions, " AND ") + ")"
+}
+
+// sortDirection returns the sql sort direction
+func sortDirection(desc bool) string {
+	if desc {
+		return " DESC"
+	}
+	return " ASC"
+}
+
+// encodeCursor returns the cursor positioned after the row, from its values of the ordering columns and its physical
+// location
+func encodeCursor(order []QuerySort, row models.Data) (string, error) {
+	cursor := queryCursor{Sort: hashValues(order), Values: make([]any, len(order))}
+	for i := range order {
+		cursor.Values[i] = row[fmt.Sprintf("%s%d", querySortAlias, i)]
+	}
+	cursor.CTID, _ = row[queryCTIDAlias].(string)
+
+	raw, err := json.Marshal(cursor)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode cursor: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// decodeCursor decodes a cursor, which must have been produced by a query with the same order
+func decodeCursor(encoded string, order []QuerySort) (queryCursor, error) {
+	var cursor queryCursor
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err == nil {
+		// numbers are kept exact, bigint sort values may exceed the precision of a float
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		err = decoder.Decode(&cursor)
+	}
+	if err != nil || cursor.CTID == "" || len(cursor.Values) != len(order) {
+		return queryCursor{}, fmt.Errorf("%w: invalid cursor", ErrInvalidQuery)
+	}
+	if cursor.Sort != hashValues(order) {
+		return queryCursor{}, fmt.Errorf("%w: cursor was produced by a query with another sort", ErrInvalidQuery)
+	}
+	return cursor, nil
+}
+
+// registerQueryRoutes registers the HTTP query API, unless QUERY_API_TOKEN is empty
+func registerQueryRoutes(mux *http.ServeMux) {
+	if queryAPIToken == "" {
+		return
+	}
+	mux.Handle("POST /query/{processorID}", requireBearerToken(queryAPIToken, http.HandlerFunc(handleQuery)))
+}
+
+// handleQuery serves a query of the table of the processor in the path, the body is a QueryRequest
+func handleQuery(w http.ResponseWriter, r *http.Request) {
+	var request QueryRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err := decoder.Decode(&request); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("%w: %v", ErrInvalidQuery, err))
+		return
+	}
+	request.ProcessorID = r.PathValue("processorID")
+
+	result, err := QueryTable(request)
+	if err != nil {
+		writeOperationError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
+)
+
+func TestQueryBreaksTiesOnKeyColumns(t *testing.T) {
+	columns := tableColumns{
+		types: map[string]ColumnType{"order_id": ColumnBigInt, "status": ColumnText, columnValidFrom: ColumnTimestamp},
+		names: map[string]string{"orderId": "order_id"},
+	}
+	sorts := []QuerySort{{Column: "status", Desc: true}}
+
+	for _, test := range []struct {
+		mode    string
+		keys    []string
+		orderBy string
+	}{
+		{WriteModeAppend, nil, `ORDER BY "status" DESC NULLS LAST, ctid`},
+		{WriteModeUpsert, []string{"orderId"}, `ORDER BY "status" DESC NULLS LAST, "order_id" ASC NULLS LAST, ctid`},
+		{WriteModeHistory, []string{"orderId"}, `ORDER BY "status" DESC NULLS LAST, "order_id" ASC NULLS LAST, "_valid_from" ASC NULLS LAST, ctid`},
+	} {
+		config := DefaultTableConfig()
+		config.WriteMode = &test.mode
+		config.KeyColumns = test.keys
+
+		order, err := queryOrder(columns, sorts, tiebreakColumns(config, columns))
+		if err != nil {
+			t.Fatal(err)
+		}
+		query, _, err := buildQuery("orders", columns, QueryRequest{Sort: sorts}, order, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(query, test.orderBy) {
+			t.Errorf("%s query %q is not ordered %s", test.mode, query, test.orderBy)
+		}
+	}
+}
+
+func TestQueryCursorFollowsKeyColumns(t *testing.T) {
+	columns := tableColumns{types: map[string]ColumnType{"order_id": ColumnBigInt, "status": ColumnText}}
+	order, err := queryOrder(columns, []QuerySort{{Column: "status"}}, []string{"order_id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cursor, err := encodeCursor(order, models.Data{querySortAlias + "0": "open", querySortAlias + "1": int64(42), queryCTIDAlias: "(0,1)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, err := buildQuery("orders", columns, QueryRequest{Sort: []QuerySort{{Column: "status"}}, Cursor: cursor}, order, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rows with the same status follow the cursor by order id, and only rows with the same order id by location
+	if !strings.Contains(query, `"status" = $1 AND ("order_id" > $2 OR "order_id" IS NULL)`) ||
+		!strings.Contains(query, `"order_id" = $2 AND ctid > $3::text::tid`) {
+		t.Errorf("query %q does not break ties on the order id ahead of the location", query)
+	}
+	if len(args) != 4 || args[0] != "open" || args[2] != "(0,1)" {
+		t.Errorf("query arguments %v, want the cursor's status, order id and location followed by the limit", args)
+	}
+
+	// a cursor of another order is refused
+	other, err := queryOrder(columns, []QuerySort{{Column: "status"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = buildQuery("orders", columns, QueryRequest{Cursor: cursor}, other, 10); err == nil {
+		t.Error("a cursor produced by another order was accepted")
+	}
+}
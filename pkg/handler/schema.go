@@ -0,0 +1,395 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
+)
+
+// ColumnType is the postgres type of a state table column
+type ColumnType string
+
+const (
+	ColumnUnknown   ColumnType = "" // no type could be inferred (e.g. only null values were seen)
+	ColumnText      ColumnType = "TEXT"
+	ColumnBigInt    ColumnType = "BIGINT"
+	ColumnDouble    ColumnType = "DOUBLE PRECISION"
+	ColumnBoolean   ColumnType = "BOOLEAN"
+	ColumnTimestamp ColumnType = "TIMESTAMPTZ"
+	ColumnJSONB     ColumnType = "JSONB"
+	ColumnUUID      ColumnType = "UUID"
+)
+
+// InferColumnType returns the column type best suited to hold a single value
+func InferColumnType(value any) ColumnType {
+	switch v := value.(type) {
+	case nil:
+		return ColumnUnknown
+	case bool:
+		return ColumnBoolean
+	case int, int8, int16, int32, int64, uint8, uint16, uint32:
+		return ColumnBigInt
+	case float32:
+		return inferFloatType(float64(v))
+	case float64:
+		return inferFloatType(v)
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return ColumnBigInt
+		}
+		return ColumnDouble
+	case time.Time:
+		return ColumnTimestamp
+	case string:
+		if _, ok := parseTimestamp(v); ok {
+			return ColumnTimestamp
+		}
+		return ColumnText
+	case map[string]any, models.Data, []any:
+		return ColumnJSONB
+	}
+	return ColumnText
+}
+
+// inferFloatType distinguishes integral json numbers (decoded as float64) from fractional ones
+func inferFloatType(v float64) ColumnType {
+	if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 && !math.IsInf(v, 0) {
+		return ColumnBigInt
+	}
+	return ColumnDouble
+}
+
+// WidenColumnType returns the narrowest type able to hold values of both types. An integer widens to a double,
+// everything fits into TEXT and JSONB, any other mix falls back to TEXT.
+func WidenColumnType(current ColumnType, incoming ColumnType) ColumnType {
+	switch {
+	case incoming == ColumnUnknown || current == incoming:
+		return current
+	case current == ColumnUnknown:
+		return incoming
+	case current == ColumnText || current == ColumnJSONB:
+		return current
+	case incoming == ColumnJSONB:
+		return ColumnJSONB
+	case current == ColumnBigInt && incoming == ColumnDouble:
+		return ColumnDouble
+	case current == ColumnDouble && incoming == ColumnBigInt:
+		return ColumnDouble
+	}
+	return ColumnText
+}
+
+// InferColumnTypes infers a type for each key across the records, widening as values disagree. Keys that only
+// ever carry null values are typed as TEXT.
+func InferColumnTypes(records []models.Data) map[string]ColumnType {
+	types := make(map[string]ColumnType)
+	for _, record := range records {
+		for key, value := range record {
+			types[key] = WidenColumnType(types[key], InferColumnType(value))
+		}
+	}
+
+	for key, columnType := range types {
+		if columnType == ColumnUnknown {
+			types[key] = ColumnText
+		}
+	}
+	return types
+}
+
+// IsInferredColumnType reports whether the type is one this processor infers, and therefore can widen
+func IsInferredColumnType(columnType ColumnType) bool {
+	switch columnType {
+	case ColumnText, ColumnBigInt, ColumnDouble, ColumnBoolean, ColumnTimestamp, ColumnJSONB:
+		return true
+	}
+	return false
+}
+
+// ColumnTypeFromDataType maps an information_schema data_type onto a column type
+func ColumnTypeFromDataType(dataType string) ColumnType {
+	switch strings.ToLower(dataType) {
+	case "text", "character varying", "character":
+		return ColumnText
+	case "bigint", "integer", "smallint":
+		return ColumnBigInt
+	case "double precision", "real":
+		return ColumnDouble
+	case "boolean":
+		return ColumnBoolean
+	case "timestamp with time zone":
+		return ColumnTimestamp
+	case "jsonb":
+		return ColumnJSONB
+	}
+	return ColumnType(strings.ToUpper(dataType))
+}
+
+// ConvertValue converts a record value into the go type bound for a column of the given type
+func ConvertValue(columnType ColumnType, value any) (any, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	switch columnType {
+	case ColumnText:
+		return toText(value)
+	case ColumnBigInt:
+		return toBigInt(value)
+	case ColumnDouble:
+		return toDouble(value)
+	case ColumnBoolean:
+		if v, ok := value.(bool); ok {
+			return v, nil
+		}
+	case ColumnTimestamp:
+		switch v := value.(type) {
+		case time.Time:
+			return v, nil
+		case string:
+			if ts, ok := parseTimestamp(v); ok {
+				return ts, nil
+			}
+		}
+	case ColumnJSONB:
+		bytes, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return string(bytes), nil
+	default:
+		// types not inferred by this processor are left for the driver to bind, structured values as json
+		switch value.(type) {
+		case map[string]any, models.Data, []any:
+			return toText(value)
+		}
+		return value, nil
+	}
+
+	return nil, fmt.Errorf("value %v of type %T cannot be stored in a %s column", value, value, columnType)
+}
+
+func toText(value any) (any, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case map[string]any, models.Data, []any:
+		bytes, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return string(bytes), nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+func toBigInt(value any) (any, error) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case float64:
+		if inferFloatType(v) == ColumnBigInt {
+			return int64(v), nil
+		}
+	case json.Number:
+		return v.Int64()
+	}
+	return nil, fmt.Errorf("value %v of type %T cannot be stored in a %s column", value, value, ColumnBigInt)
+}
+
+func toDouble(value any) (any, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case json.Number:
+		return v.Float64()
+	}
+
+	if i, err := toBigInt(value); err == nil {
+		return float64(i.(int64)), nil
+	}
+	return nil, fmt.Errorf("value %v of type %T cannot be stored in a %s column", value, value, ColumnDouble)
+}
+
+// parseTimestamp parses RFC 3339 timestamps, the format used for generated timestamps
+func parseTimestamp(value string) (time.Time, bool) {
+	// cheap pre-check to avoid parsing arbitrary text
+	if len(value) < len("2006-01-02T15:04:05Z") || value[4] != '-' || value[10] != 'T' {
+		return time.Time{}, false
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ts, true
+}
+
+// columnTypeAliases maps the type names accepted in a declared schema onto column types
+var columnTypeAliases = map[string]ColumnType{
+	"text":             ColumnText,
+	"string":           ColumnText,
+	"varchar":          ColumnText,
+	"bigint":           ColumnBigInt,
+	"int":              ColumnBigInt,
+	"integer":          ColumnBigInt,
+	"long":             ColumnBigInt,
+	"double":           ColumnDouble,
+	"double precision": ColumnDouble,
+	"float":            ColumnDouble,
+	"number":           ColumnDouble,
+	"boolean":          ColumnBoolean,
+	"bool":             ColumnBoolean,
+	"timestamp":        ColumnTimestamp,
+	"timestamptz":      ColumnTimestamp,
+	"jsonb":            ColumnJSONB,
+	"json":             ColumnJSONB,
+	"numeric":          "NUMERIC",
+	"date":             "DATE",
+	"uuid":             ColumnUUID,
+}
+
+// defaultExpressions are the non-literal column defaults a declared schema may use
+var defaultExpressions = map[string]string{
+	"now()":             "now()",
+	"current_timestamp": "CURRENT_TIMESTAMP",
+	"gen_random_uuid()": "gen_random_uuid()",
+}
+
+// ParseColumnType resolves a type name from a declared schema
+func ParseColumnType(name string) (ColumnType, error) {
+	if columnType, ok := columnTypeAliases[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return columnType, nil
+	}
+	return ColumnUnknown, fmt.Errorf("unsupported column type %q", name)
+}
+
+// DefaultExpression renders a declared column default as sql, either a supported expression or a quoted literal
+func DefaultExpression(value any) (string, error) {
+	switch v := value.(type) {
+	case bool:
+		return strings.ToUpper(strconv.FormatBool(v)), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case string:
+		if expression, ok := defaultExpressions[strings.ToLower(v)]; ok {
+			return expression, nil
+		}
+		return quoteLiteral(v), nil
+	case map[string]any, []any:
+		bytes, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return quoteLiteral(string(bytes)), nil
+	}
+	return "", fmt.Errorf("unsupported default value %v of type %T", value, value)
+}
+
+// quoteLiteral quotes a string as a sql literal
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// ConformRecord checks a record against the declared columns. Under the coerce policy undeclared keys are dropped
+// and string values are parsed into the column type where possible, under the reject policy any deviation is a
+// violation. Returns the record to insert, or the violations when the record cannot be inserted.
+func ConformRecord(record models.Data, columns []ColumnDefinition, policy string) (models.Data, []string) {
+	var violations []string
+	conformed := make(models.Data, len(record))
+
+	declared := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		declared[column.Name] = true
+
+		value, exists := record[column.Name]
+		if !exists || value == nil {
+			if column.IsNullable() || column.Default != nil {
+				continue // null, or omitted such that the column default applies
+			}
+			violations = append(violations, fmt.Sprintf("column %q is required", column.Name))
+			continue
+		}
+
+		converted := value
+		if _, err := ConvertValue(column.ColumnType(), value); err != nil {
+			if policy == SchemaPolicyReject {
+				violations = append(violations, fmt.Sprintf("column %q: %v", column.Name, err))
+				continue
+			}
+			if converted, err = coerceValue(column.ColumnType(), value); err != nil {
+				violations = append(violations, fmt.Sprintf("column %q: %v", column.Name, err))
+				continue
+			}
+		}
+		conformed[column.Name] = converted
+	}
+
+	if policy == SchemaPolicyReject {
+		for key := range record {
+			if !declared[key] {
+				violations = append(violations, fmt.Sprintf("key %q is not a declared column", key))
+			}
+		}
+	}
+
+	if len(violations) > 0 {
+		return nil, violations
+	}
+	return conformed, nil
+}
+
+// coerceValue parses string values into the given column type
+func coerceValue(columnType ColumnType, value any) (any, error) {
+	if s, ok := value.(string); ok {
+		s = strings.TrimSpace(s)
+		switch columnType {
+		case ColumnBigInt:
+			if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return v, nil
+			}
+		case ColumnDouble:
+			if v, err := strconv.ParseFloat(s, 64); err == nil {
+				return v, nil
+			}
+		case ColumnBoolean:
+			if v, err := strconv.ParseBool(s); err == nil {
+				return v, nil
+			}
+		case ColumnTimestamp:
+			for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05Z07:00", "2006-01-02 15:04:05", "2006-01-02"} {
+				if v, err := time.Parse(layout, s); err == nil {
+					return v, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("value %v of type %T cannot be coerced to %s", value, value, columnType)
+}
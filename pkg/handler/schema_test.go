@@ -0,0 +1,212 @@
+package handler
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
+)
+
+func TestInferColumnType(t *testing.T) {
+	for _, test := range []struct {
+		value any
+		want  ColumnType
+	}{
+		{nil, ColumnUnknown},
+		{true, ColumnBoolean},
+		{42, ColumnBigInt},
+		{float64(42), ColumnBigInt}, // json numbers are decoded as float64
+		{42.5, ColumnDouble},
+		{math.Inf(1), ColumnDouble},
+		{float64(math.MaxInt64), ColumnDouble}, // beyond the range of a BIGINT
+		{json.Number("42"), ColumnBigInt},
+		{json.Number("42.5"), ColumnDouble},
+		{"2024-01-02T03:04:05Z", ColumnTimestamp},
+		{"2024-01-02", ColumnText},
+		{"label", ColumnText},
+		{time.Now(), ColumnTimestamp},
+		{map[string]any{"a": 1}, ColumnJSONB},
+		{models.Data{"a": 1}, ColumnJSONB},
+		{[]any{1, 2}, ColumnJSONB},
+	} {
+		if got := InferColumnType(test.value); got != test.want {
+			t.Errorf("InferColumnType(%#v) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestWidenColumnType(t *testing.T) {
+	for _, test := range []struct {
+		current, incoming, want ColumnType
+	}{
+		{ColumnBigInt, ColumnUnknown, ColumnBigInt},
+		{ColumnUnknown, ColumnBigInt, ColumnBigInt},
+		{ColumnBigInt, ColumnBigInt, ColumnBigInt},
+		{ColumnBigInt, ColumnDouble, ColumnDouble},
+		{ColumnDouble, ColumnBigInt, ColumnDouble},
+		{ColumnDouble, ColumnText, ColumnText},
+		{ColumnBigInt, ColumnBoolean, ColumnText},
+		{ColumnTimestamp, ColumnBigInt, ColumnText},
+		{ColumnBigInt, ColumnJSONB, ColumnJSONB},
+		{ColumnText, ColumnJSONB, ColumnText}, // text already holds the json of structured values
+		{ColumnJSONB, ColumnText, ColumnJSONB},
+		{ColumnText, ColumnBigInt, ColumnText},
+	} {
+		if got := WidenColumnType(test.current, test.incoming); got != test.want {
+			t.Errorf("WidenColumnType(%q, %q) = %q, want %q", test.current, test.incoming, got, test.want)
+		}
+	}
+}
+
+func TestInferColumnTypesWidensAcrossRecords(t *testing.T) {
+	records := []models.Data{
+		{"count": float64(1), "score": float64(1), "label": "a", "payload": "a", "empty": nil},
+		{"count": float64(2), "score": 1.5, "label": float64(1), "payload": map[string]any{"a": "b"}},
+		{"score": "high"},
+	}
+	want := map[string]ColumnType{
+		"count":   ColumnBigInt,
+		"score":   ColumnText, // int, then float, then text
+		"label":   ColumnText,
+		"payload": ColumnText,
+		"empty":   ColumnText, // only null values
+	}
+	if got := InferColumnTypes(records); !reflect.DeepEqual(got, want) {
+		t.Errorf("InferColumnTypes = %v, want %v", got, want)
+	}
+}
+
+func TestConvertValue(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, test := range []struct {
+		columnType ColumnType
+		value      any
+		want       any
+		fails      bool
+	}{
+		{ColumnText, nil, nil, false},
+		{ColumnText, "a", "a", false},
+		{ColumnText, float64(42), "42", false},
+		{ColumnText, 1.5, "1.5", false},
+		{ColumnText, true, "true", false},
+		{ColumnText, ts, "2024-01-02T03:04:05Z", false},
+		{ColumnText, map[string]any{"a": "b"}, `{"a":"b"}`, false},
+		{ColumnBigInt, float64(42), int64(42), false},
+		{ColumnBigInt, int32(42), int64(42), false},
+		{ColumnBigInt, json.Number("42"), int64(42), false},
+		{ColumnBigInt, 1.5, nil, true},
+		{ColumnBigInt, "42", nil, true},
+		{ColumnDouble, float64(42), float64(42), false},
+		{ColumnDouble, 42, float64(42), false},
+		{ColumnDouble, json.Number("1.5"), 1.5, false},
+		{ColumnDouble, "1.5", nil, true},
+		{ColumnBoolean, true, true, false},
+		{ColumnBoolean, "true", nil, true},
+		{ColumnTimestamp, "2024-01-02T03:04:05Z", ts, false},
+		{ColumnTimestamp, ts, ts, false},
+		{ColumnTimestamp, "yesterday", nil, true},
+		{ColumnJSONB, map[string]any{"a": "b"}, `{"a":"b"}`, false},
+		{ColumnJSONB, "a", `"a"`, false}, // text values of a column widened to jsonb are json strings
+		{ColumnJSONB, float64(42), "42", false},
+		{ColumnUUID, "3f1c2a9e-5b7d-4e8f-9a0b-1c2d3e4f5a6b", "3f1c2a9e-5b7d-4e8f-9a0b-1c2d3e4f5a6b", false},
+		{"NUMERIC", []any{1}, "[1]", false},
+	} {
+		got, err := ConvertValue(test.columnType, test.value)
+		if (err != nil) != test.fails {
+			t.Errorf("ConvertValue(%q, %#v) returned error %v, want failure %v", test.columnType, test.value, err, test.fails)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ConvertValue(%q, %#v) = %#v, want %#v", test.columnType, test.value, got, test.want)
+		}
+	}
+}
+
+func TestConvertExpression(t *testing.T) {
+	for _, test := range []struct {
+		columnType ColumnType
+		want       string
+	}{
+		{ColumnDouble, `"score"::DOUBLE PRECISION`},
+		{ColumnText, `"score"::TEXT`},
+		{ColumnJSONB, `to_jsonb("score")`}, // scalars have no cast to jsonb
+	} {
+		if got := convertExpression("score", test.columnType); got != test.want {
+			t.Errorf("convertExpression(%q) = %s, want %s", test.columnType, got, test.want)
+		}
+	}
+}
+
+func TestConformRecord(t *testing.T) {
+	notNull := false
+	config := DefaultTableConfig()
+	config.Columns = []ColumnDefinition{
+		{Name: "id", Type: "bigint", PrimaryKey: true},
+		{Name: "score", Type: "double", Nullable: &notNull},
+		{Name: "label", Type: "text", Nullable: &notNull, Default: "unknown"},
+		{Name: "at", Type: "timestamptz"},
+	}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	columns := config.ColumnDefinitions()
+	at := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		name       string
+		policy     string
+		record     models.Data
+		want       models.Data
+		violations int
+	}{
+		{
+			name:   "conforming",
+			policy: SchemaPolicyReject,
+			record: models.Data{"id": float64(1), "score": 1.5, "label": "a", "at": "2024-01-02T00:00:00Z"},
+			want:   models.Data{"id": float64(1), "score": 1.5, "label": "a", "at": "2024-01-02T00:00:00Z"},
+		},
+		{
+			name:   "coerced strings and dropped undeclared keys",
+			policy: SchemaPolicyCoerce,
+			record: models.Data{"id": " 1 ", "score": "1.5", "at": "2024-01-02", "extra": true},
+			want:   models.Data{"id": int64(1), "score": 1.5, "at": at},
+		},
+		{
+			name:   "omitted column with a default",
+			policy: SchemaPolicyCoerce,
+			record: models.Data{"id": float64(1), "score": float64(2)},
+			want:   models.Data{"id": float64(1), "score": float64(2)},
+		},
+		{
+			name:       "missing primary key and required column",
+			policy:     SchemaPolicyCoerce,
+			record:     models.Data{"label": "a"},
+			violations: 2,
+		},
+		{
+			name:       "value that cannot be coerced",
+			policy:     SchemaPolicyCoerce,
+			record:     models.Data{"id": float64(1), "score": "high"},
+			violations: 1,
+		},
+		{
+			name:       "mistyped value and undeclared key",
+			policy:     SchemaPolicyReject,
+			record:     models.Data{"id": "1", "score": float64(2), "extra": true},
+			violations: 2,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, violations := ConformRecord(test.record, columns, test.policy)
+			if len(violations) != test.violations {
+				t.Fatalf("ConformRecord returned violations %q, want %d", violations, test.violations)
+			}
+			if test.violations == 0 && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ConformRecord = %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
@@ -2,14 +2,15 @@ package handler
 
 import (
 	"context"
+	"fmt"
 	"github.com/quantumwake/alethic-ism-core-go/pkg/cache"
 	"github.com/quantumwake/alethic-ism-core-go/pkg/repository/processor"
 	"github.com/quantumwake/alethic-ism-core-go/pkg/repository/route"
-	"github.com/quantumwake/alethic-ism-core-go/pkg/repository/state"
 	"github.com/quantumwake/alethic-ism-core-go/pkg/routing"
 	rnats "github.com/quantumwake/alethic-ism-core-go/pkg/routing/nats"
 	"log"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -17,17 +18,22 @@ const (
 	SelectorSubscriber = "data/transformers/mixer/state-tables-1.0"
 	SelectorMonitor    = "processor/monitor"
 	SelectorStoreSync  = "processor/state/sync"
+	SelectorRouter     = "processor/state/router"
+	SelectorControl    = "data/transformers/mixer/state-tables-1.0/control"
 )
 
 var (
 	dsn = os.Getenv("DSN")
 
-	subscriberRoute routing.Route // the route we are listening on
-	monitorRoute    routing.Route // route for sending errors
-	syncRoute       routing.Route // route for sending sync messages
+	subscriberRoute  routing.Route      // the route we are listening on
+	cancelSubscriber context.CancelFunc // stops the subscriber from fetching messages, on shutdown
+	controlRoute     routing.Route      // the route control commands are received on, nil when not configured
+	monitorRoute     routing.Route      // route for sending errors
+	syncRoute        routing.Route      // route for sending sync messages
 
-	// no cache
-	stateBackend = state.NewBackend(dsn)
+	// route for forwarding records to output routes, connected on first use since only forwarding processors need it
+	routerRoute routing.Route
+	routerMu    sync.Mutex
 
 	// backendCache
 	backendCache     cache.Cache
@@ -57,11 +63,19 @@ func Startup(ctx context.Context) {
 		panic(err)
 	}
 
-	// set up listener route such that events can be received from the NATS server and processed
-	if subscriberRoute, err = rnats.NewRouteSubscriberUsingSelector(ctx, SelectorSubscriber, MessageCallback); err != nil {
+	// set up listener route such that events can be received from the NATS server and processed, under its own
+	// context such that a pull subscriber stops fetching once it is cancelled on shutdown
+	var subscriberCtx context.Context
+	subscriberCtx, cancelSubscriber = context.WithCancel(ctx)
+	if subscriberRoute, err = rnats.NewRouteSubscriberUsingSelector(subscriberCtx, SelectorSubscriber, MessageCallback); err != nil {
 		log.Fatalf("unable to create nats route subscriber: %v", err)
 	}
 
+	// messages held until their batch is flushed are reported in progress well within the ack wait of the subscriber
+	if route, ok := subscriberRoute.(*rnats.Route); ok && route.Config.AckWait != nil && *route.Config.AckWait > 0 {
+		ackProgressInterval = min(ackProgressInterval, time.Duration(*route.Config.AckWait)*time.Second/3)
+	}
+
 	// setup other require routes, monitor, state sync, state router
 	if monitorRoute, err = rnats.NewRouteUsingSelector(ctx, SelectorMonitor); err != nil {
 		log.Fatalf("unable to create nats route: %v", err)
@@ -70,30 +84,107 @@ func Startup(ctx context.Context) {
 	if syncRoute, err = rnats.NewRouteUsingSelector(ctx, SelectorStoreSync); err != nil {
 		log.Fatalf("unable to initialize route: %v", err)
 	}
+
+	// the control route is optional, commands are only accepted when it is configured
+	if controlRoute, err = rnats.NewRouteSubscriberUsingSelector(ctx, SelectorControl, ControlCallback); err != nil {
+		log.Printf("control route is disabled: %v\n", err)
+		controlRoute = nil
+	}
+
+	StartHTTPServer(ctx)
+}
+
+// stateRouter returns the state router route, connecting to it on first use
+func stateRouter(ctx context.Context) (routing.Route, error) {
+	routerMu.Lock()
+	defer routerMu.Unlock()
+
+	if routerRoute == nil {
+		route, err := rnats.NewRouteUsingSelector(ctx, SelectorRouter)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create state router route: %w", err)
+		}
+		routerRoute = route
+	}
+	return routerRoute, nil
+}
+
+// connectedStateRouter returns the state router route, or nil when it was never used
+func connectedStateRouter() routing.Route {
+	routerMu.Lock()
+	defer routerMu.Unlock()
+	return routerRoute
 }
 
+// Teardown shuts the service down in order, such that every message received is either flushed and acked or
+// redelivered: the subscription is stopped, callbacks in flight are awaited, every writer is flushed (publishing the
+// final statuses and acking its messages), the published statuses are flushed and only then are the routes
+// disconnected. The steps are bounded by the context deadline, messages left unacked are redelivered.
 func Teardown(ctx context.Context) {
-	// Stop all batch writers and cleanup goroutines
-	StopWriterCache()
+	// stop consuming, messages still delivered are redelivered. The fetch loop of a pull subscriber is stopped first,
+	// since it would otherwise keep fetching from the closed subscription; callbacks in flight are unaffected, acks
+	// and publishes do not depend on the context.
+	cancelSubscriber()
+	if err := subscriberRoute.Unsubscribe(ctx); err != nil {
+		log.Printf("error unsubscribing: %v\n", err)
+	}
+
+	if controlRoute != nil {
+		if err := controlRoute.Unsubscribe(ctx); err != nil {
+			log.Printf("error unsubscribing control route: %v\n", err)
+		}
+	}
+
+	if err := closeIntake(ctx); err != nil {
+		log.Printf("error waiting for in flight messages: %v\n", err)
+	}
+
+	// Stop all batch writers, flushing their remaining batches
+	if err := StopWriterCache(ctx); err != nil {
+		log.Printf("error flushing batch writers: %v\n", err)
+	}
 
 	if backendCache != nil {
 		backendCache.Close()
 	}
 
-	if err := subscriberRoute.Unsubscribe(ctx); err != nil {
-		return
+	// make sure the final statuses and acks are sent before disconnecting
+	routes := []routing.Route{monitorRoute, syncRoute, subscriberRoute}
+	router := connectedStateRouter()
+	if router != nil {
+		routes = append(routes, router)
+	}
+	for _, route := range routes {
+		if err := route.Flush(); err != nil {
+			log.Printf("error flushing route: %v\n", err)
+		}
 	}
 
 	if err := subscriberRoute.Disconnect(ctx); err != nil {
-		panic(err)
+		log.Printf("error disconnecting subscriber route: %v\n", err)
 	}
 
 	if err := syncRoute.Disconnect(ctx); err != nil {
-		panic(err)
+		log.Printf("error disconnecting sync route: %v\n", err)
+	}
+
+	if router != nil {
+		if err := router.Disconnect(ctx); err != nil {
+			log.Printf("error disconnecting state router route: %v\n", err)
+		}
 	}
 
 	if err := monitorRoute.Disconnect(ctx); err != nil {
-		panic(err)
+		log.Printf("error disconnecting monitor route: %v\n", err)
 	}
 
+	if controlRoute != nil {
+		if err := controlRoute.Disconnect(ctx); err != nil {
+			log.Printf("error disconnecting control route: %v\n", err)
+		}
+	}
+
+	if err := StopHTTPServer(ctx); err != nil {
+		log.Printf("error stopping http server: %v\n", err)
+	}
 }
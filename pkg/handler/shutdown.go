@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/utils"
+)
+
+var (
+	// ShutdownTimeout bounds the graceful shutdown, it must stay below the termination grace period of the pod
+	ShutdownTimeout = utils.DurationFromEnvWithDefault("SHUTDOWN_TIMEOUT", 25*time.Second)
+
+	intakeMu     sync.RWMutex          // Guards intakeClosed against callbacks entering while the intake is closed
+	intakeClosed bool                  // Whether the service stopped accepting messages
+	intakeDone   = make(chan struct{}) // Closed along with the intake, waking callbacks blocked on a full buffer
+	inflight     sync.WaitGroup        // Callbacks currently processing a message
+)
+
+// beginCallback registers a callback as in flight, it returns false once the intake is closed
+func beginCallback() bool {
+	intakeMu.RLock()
+	defer intakeMu.RUnlock()
+
+	if intakeClosed {
+		return false
+	}
+	inflight.Add(1)
+	return true
+}
+
+// intakeOpen reports whether the service accepts messages
+func intakeOpen() bool {
+	intakeMu.RLock()
+	defer intakeMu.RUnlock()
+	return !intakeClosed
+}
+
+// intakeClosing returns a channel closed once the intake is closed
+func intakeClosing() <-chan struct{} {
+	intakeMu.RLock()
+	defer intakeMu.RUnlock()
+	return intakeDone
+}
+
+// endCallback marks a callback registered by beginCallback as done
+func endCallback() {
+	inflight.Done()
+}
+
+// closeIntake stops accepting messages and waits for the callbacks in flight, or until the context is done. Callbacks
+// blocked on a full buffer give up such that their messages are redelivered rather than outliving the shutdown.
+func closeIntake(ctx context.Context) error {
+	intakeMu.Lock()
+	if !intakeClosed {
+		intakeClosed = true
+		close(intakeDone)
+	}
+	intakeMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,471 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/utils"
+)
+
+const (
+	spoolSegmentExt    = ".seg"       // extension of the spool segment files
+	spoolCheckpoint    = "checkpoint" // file holding the position up to which the spool is consumed
+	spoolEntryOverhead = 8            // bytes preceding each entry: payload length and checksum
+)
+
+var (
+	// Directory of the write-ahead spool, every record is spooled before its message is acknowledged when set
+	spoolDir = os.Getenv("SPOOL_DIR")
+
+	// Directory of the records spilled by the spill backpressure policy when the spool is disabled, the spill policy
+	// falls back to redelivering messages without one
+	spillDir = os.Getenv("SPILL_DIR")
+
+	// Size at which the active segment is sealed and a new one started
+	spoolSegmentSize = utils.Int64FromEnvWithDefault("SPOOL_SEGMENT_SIZE", 64<<20)
+
+	// How often a spool holding records is replayed when time based flushing is disabled
+	spoolReplayInterval = utils.DurationFromEnvWithDefault("SPOOL_REPLAY_INTERVAL", 10*time.Second)
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+var (
+	// Transient errors, the message is redelivered
+	ErrSpoolWrite = errors.New("failed to spool records")
+)
+
+// spoolEnabled reports whether every record is spooled to disk before its message is acknowledged
+func spoolEnabled() bool {
+	return spoolDir != ""
+}
+
+// spooledRecord is a record in the spool, the payload of a spool entry
+type spooledRecord struct {
+	RouteID    string      `json:"route_id"`
+	Data       models.Data `json:"data"`
+	IngestedAt time.Time   `json:"ingested_at"`
+}
+
+// spoolPosition is a position in the spool, an offset into a segment
+type spoolPosition struct {
+	segment uint64
+	offset  int64
+}
+
+// before reports whether the position precedes the other position
+func (p spoolPosition) before(other spoolPosition) bool {
+	return p.segment < other.segment || (p.segment == other.segment && p.offset < other.offset)
+}
+
+// spoolSegment is a segment file of the spool
+type spoolSegment struct {
+	seq  uint64
+	size int64
+}
+
+// spool is a write-ahead log of records on local disk, made of numbered segment files. Each entry is a length
+// prefixed, CRC-32C checksummed JSON record, and every append is synced to disk before returning. Records are loaded
+// back in order and only consumed once the batch holding them is committed, at which point the checkpoint is
+// persisted and fully consumed segments are deleted.
+type spool struct {
+	dir        string
+	segments   []spoolSegment // in order, the last one is the active segment appended to
+	checkpoint spoolPosition  // records before the checkpoint are consumed, persisted on commit
+	pending    spoolPosition  // position past the records loaded into the current batch
+}
+
+// openSpool opens the spool of a processor in the given directory, resuming the records spooled before a restart.
+// A partially written entry at the end of the active segment, e.g. after a crash while spooling, is truncated.
+func openSpool(baseDir string, processorID string) (*spool, error) {
+	s := &spool{dir: filepath.Join(baseDir, processorID)}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory %s: %w", s.dir, err)
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory %s: %w", s.dir, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, spoolSegment{seq: seq, size: info.Size()})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	if err = s.readCheckpoint(); err != nil {
+		return nil, err
+	}
+
+	if len(s.segments) > 0 {
+		if err = s.repairActive(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case len(s.segments) == 0 || s.active().seq < s.checkpoint.segment:
+		// every segment was consumed, appends continue in the segment following the checkpoint
+		s.checkpoint.offset = 0
+		s.segments = append(s.segments, spoolSegment{seq: s.checkpoint.segment})
+	case s.checkpoint.before(spoolPosition{segment: s.segments[0].seq}):
+		s.checkpoint = spoolPosition{segment: s.segments[0].seq}
+	}
+	s.pending = s.checkpoint
+
+	// segments consumed before a crash may not have been deleted yet
+	if err = s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// segmentPath returns the path of a segment file
+func (s *spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSegmentExt))
+}
+
+// active returns the segment appended to
+func (s *spool) active() *spoolSegment {
+	return &s.segments[len(s.segments)-1]
+}
+
+// backlog returns the bytes of records spooled and not yet consumed, none without a spool
+func (s *spool) backlog() int64 {
+	if s == nil {
+		return 0
+	}
+
+	var backlog int64
+	for _, segment := range s.segments {
+		if segment.seq >= s.checkpoint.segment {
+			backlog += segment.size
+		}
+	}
+	return backlog - s.checkpoint.offset
+}
+
+// append writes the records as entries at the end of the active segment, synced to disk before returning. The active
+// segment is sealed and a new one started once it reaches the segment size.
+func (s *spool) append(records []batchRecord) (err error) {
+	if s.active().size >= spoolSegmentSize {
+		s.segments = append(s.segments, spoolSegment{seq: s.active().seq + 1})
+	}
+
+	active := s.active()
+	file, err := os.OpenFile(s.segmentPath(active.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// a failed append must not leave a partial entry that later appends would follow
+	defer func() {
+		if err != nil {
+			_ = file.Truncate(active.size)
+		}
+	}()
+
+	writer := bufio.NewWriter(file)
+	var written int64
+	for _, record := range records {
+		var payload []byte
+		if payload, err = json.Marshal(spooledRecord{RouteID: record.routeID, Data: record.data, IngestedAt: record.ingestedAt}); err != nil {
+			return err
+		}
+
+		var header [spoolEntryOverhead]byte
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, crcTable))
+		if _, err = writer.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err = writer.Write(payload); err != nil {
+			return err
+		}
+		written += int64(len(header) + len(payload))
+	}
+
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+
+	// the entry of a new segment file in the directory must be durable as well as its content
+	if active.size == 0 {
+		if err = syncDir(s.dir); err != nil {
+			return err
+		}
+	}
+	active.size += written
+	return nil
+}
+
+// load reads the records following those already loaded, up to the given number of records and bytes (zero is
+// unbounded). It returns the records, the position past them and the bytes they occupy, the records are only
+// marked as loaded by advance.
+func (s *spool) load(maxRecords int64, maxBytes int64) ([]batchRecord, spoolPosition, int64, error) {
+	position := s.pending
+	var records []batchRecord
+	var loaded int64
+	for _, segment := range s.segments {
+		if segment.seq < position.segment {
+			continue
+		}
+		if (maxRecords > 0 && int64(len(records)) >= maxRecords) || (maxBytes > 0 && len(records) > 0 && loaded >= maxBytes) {
+			break
+		}
+		if segment.seq > position.segment {
+			position = spoolPosition{segment: segment.seq}
+		}
+
+		read, next, size, err := s.readSegment(segment, position.offset, maxRecords-int64(len(records)), maxBytes-loaded, maxRecords > 0, maxBytes > 0)
+		if err != nil {
+			return nil, s.pending, 0, err
+		}
+		records = append(records, read...)
+		loaded += size
+		position.offset = next
+
+		if next < segment.size {
+			break // limits reached
+		}
+	}
+	return records, position, loaded, nil
+}
+
+// readSegment reads the entries of a segment from the offset, up to the limits, returning the records, the offset
+// past them and the bytes read. A corrupt entry ends the segment, the remainder of a sealed segment is skipped.
+func (s *spool) readSegment(segment spoolSegment, offset int64, maxRecords int64, maxBytes int64, limitRecords bool, limitBytes bool) ([]batchRecord, int64, int64, error) {
+	if offset >= segment.size {
+		return nil, offset, 0, nil
+	}
+
+	file, err := os.Open(s.segmentPath(segment.seq))
+	if err != nil {
+		return nil, offset, 0, err
+	}
+	defer file.Close()
+
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, 0, err
+	}
+
+	var records []batchRecord
+	var read int64
+	reader := bufio.NewReader(file)
+	for offset+read < segment.size {
+		if limitRecords && int64(len(records)) >= maxRecords {
+			break
+		}
+
+		payload, err := readSpoolEntry(reader, segment.size-offset-read)
+		if err != nil {
+			log.Printf("skipping corrupt spool segment %s from offset %d: %v\n", s.segmentPath(segment.seq), offset+read, err)
+			return records, segment.size, read, nil
+		}
+
+		size := int64(spoolEntryOverhead + len(payload))
+		if limitBytes && len(records) > 0 && read+size > maxBytes {
+			break
+		}
+		read += size
+
+		var record spooledRecord
+		if err = json.Unmarshal(payload, &record); err != nil {
+			log.Printf("skipping undecodable record in spool segment %s: %v\n", s.segmentPath(segment.seq), err)
+			continue
+		}
+		records = append(records, batchRecord{routeID: record.RouteID, data: record.Data, ingestedAt: record.IngestedAt, size: size})
+	}
+	return records, offset + read, read, nil
+}
+
+// readSpoolEntry reads a single entry within the remaining bytes of its segment, verifying its checksum. A length
+// beyond the remaining bytes, e.g. a corrupt header, is refused before its payload is allocated.
+func readSpoolEntry(reader io.Reader, remaining int64) ([]byte, error) {
+	var header [spoolEntryOverhead]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length > remaining-spoolEntryOverhead {
+		return nil, fmt.Errorf("entry length %d exceeds the %d bytes remaining in the segment", length, remaining-spoolEntryOverhead)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return payload, nil
+}
+
+// advance marks the records up to the position as loaded into the current batch
+func (s *spool) advance(position spoolPosition) {
+	s.pending = position
+}
+
+// commit consumes the records loaded so far, persisting the checkpoint and deleting the segments fully consumed.
+// Once every record is consumed, a new segment is started such that the consumed active segment is deleted as well.
+func (s *spool) commit() error {
+	if s == nil || s.pending == s.checkpoint {
+		return nil
+	}
+	s.checkpoint = s.pending
+
+	if active := s.active(); s.checkpoint.segment == active.seq && s.checkpoint.offset >= active.size {
+		s.segments = append(s.segments, spoolSegment{seq: active.seq + 1})
+		s.checkpoint = spoolPosition{segment: active.seq + 1}
+		s.pending = s.checkpoint
+	}
+
+	// the checkpoint is persisted before the segments preceding it are deleted
+	if err := s.writeCheckpoint(); err != nil {
+		return err
+	}
+	return s.compact()
+}
+
+// compact deletes the segments preceding the checkpoint, every record in them is consumed
+func (s *spool) compact() error {
+	for len(s.segments) > 1 && s.segments[0].seq < s.checkpoint.segment {
+		if err := os.Remove(s.segmentPath(s.segments[0].seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to delete consumed spool segment: %w", err)
+		}
+		s.segments = s.segments[1:]
+	}
+	return nil
+}
+
+// discard consumes every spooled record, loaded or not, deleting the segments holding them
+func (s *spool) discard() error {
+	if s == nil {
+		return nil
+	}
+	s.pending = spoolPosition{segment: s.active().seq, offset: s.active().size}
+	return s.commit()
+}
+
+// rollback returns the records loaded since the last commit to the spool, such that they are loaded again
+func (s *spool) rollback() {
+	if s == nil {
+		return
+	}
+	s.pending = s.checkpoint
+}
+
+// readCheckpoint reads the persisted checkpoint, the start of the spool when there is none
+func (s *spool) readCheckpoint() error {
+	bytes, err := os.ReadFile(filepath.Join(s.dir, spoolCheckpoint))
+	if errors.Is(err, os.ErrNotExist) {
+		if len(s.segments) > 0 {
+			s.checkpoint = spoolPosition{segment: s.segments[0].seq}
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read spool checkpoint: %w", err)
+	}
+
+	if _, err = fmt.Sscanf(string(bytes), "%d %d", &s.checkpoint.segment, &s.checkpoint.offset); err != nil {
+		return fmt.Errorf("failed to parse spool checkpoint %q: %w", string(bytes), err)
+	}
+	return nil
+}
+
+// writeCheckpoint persists the checkpoint atomically, by renaming a synced temporary file over it
+func (s *spool) writeCheckpoint() error {
+	path := filepath.Join(s.dir, spoolCheckpoint)
+	tmp := path + ".tmp"
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to write spool checkpoint: %w", err)
+	}
+	if _, err = fmt.Fprintf(file, "%d %d", s.checkpoint.segment, s.checkpoint.offset); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write spool checkpoint: %w", err)
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write spool checkpoint: %w", err)
+	}
+	return syncDir(s.dir)
+}
+
+// repairActive truncates the active segment after its last complete, valid entry
+func (s *spool) repairActive() error {
+	active := s.active()
+	file, err := os.OpenFile(s.segmentPath(active.seq), os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var valid int64
+	reader := bufio.NewReader(file)
+	for {
+		payload, err := readSpoolEntry(reader, active.size-valid)
+		if err != nil {
+			break
+		}
+		valid += int64(spoolEntryOverhead + len(payload))
+	}
+
+	if valid < active.size {
+		log.Printf("truncating spool segment %s from %d to %d bytes after an incomplete write\n",
+			s.segmentPath(active.seq), active.size, valid)
+		if err = file.Truncate(valid); err != nil {
+			return err
+		}
+		if err = file.Sync(); err != nil {
+			return err
+		}
+		active.size = valid
+	}
+	return nil
+}
+
+// syncDir syncs a directory, such that renames and new files within it are durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
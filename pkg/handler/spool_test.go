@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"encoding/binary"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
+)
+
+func TestSpoolDiscardConsumesEveryRecord(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(dir, "processor")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := make([]batchRecord, 3)
+	for i := range records {
+		records[i] = batchRecord{routeID: "route", data: models.Data{"id": float64(i)}, ingestedAt: time.Now().UTC()}
+	}
+	if err = s.append(records); err != nil {
+		t.Fatal(err)
+	}
+
+	// a record loaded into the batch is discarded along with those not loaded yet
+	loaded, position, _, err := s.load(1, 0)
+	if err != nil || len(loaded) != 1 {
+		t.Fatalf("loaded %d records (%v), want 1", len(loaded), err)
+	}
+	s.advance(position)
+
+	if err = s.discard(); err != nil {
+		t.Fatal(err)
+	}
+	if backlog := s.backlog(); backlog != 0 {
+		t.Errorf("spool holds %d bytes after discarding, want none", backlog)
+	}
+
+	// nothing is replayed after a restart
+	reopened, err := openSpool(dir, "processor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed, _, _, err := reopened.load(0, 0); err != nil || len(replayed) != 0 {
+		t.Errorf("replayed %d records (%v) after discarding, want none", len(replayed), err)
+	}
+}
+
+func TestSpoolReopen(t *testing.T) {
+	// entryOffset returns the offset of the nth entry of a segment file
+	entryOffset := func(t *testing.T, path string, n int) int64 {
+		t.Helper()
+		bytes, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var offset int64
+		for range n {
+			offset += spoolEntryOverhead + int64(binary.BigEndian.Uint32(bytes[offset:offset+4]))
+		}
+		return offset
+	}
+	// overwrite writes the bytes at an offset of a segment file
+	overwrite := func(t *testing.T, path string, offset int64, bytes []byte) {
+		t.Helper()
+		file, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if _, err = file.WriteAt(bytes, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name   string
+		damage func(t *testing.T, s *spool, path string)
+		want   []float64 // ids replayed after reopening, before the id appended once reopened
+	}{
+		{
+			name:   "intact",
+			damage: func(*testing.T, *spool, string) {},
+			want:   []float64{0, 1, 2},
+		},
+		{
+			name: "torn tail",
+			damage: func(t *testing.T, _ *spool, path string) {
+				overwrite(t, path, entryOffset(t, path, 3), []byte{0, 0, 0, 64, 1, 2, 3, 4, '{'})
+			},
+			want: []float64{0, 1, 2},
+		},
+		{
+			name: "corrupt checksum",
+			damage: func(t *testing.T, _ *spool, path string) {
+				overwrite(t, path, entryOffset(t, path, 1)+4, []byte{0, 0, 0, 0})
+			},
+			want: []float64{0},
+		},
+		{
+			name: "oversized length",
+			damage: func(t *testing.T, _ *spool, path string) {
+				overwrite(t, path, entryOffset(t, path, 1), []byte{0xff, 0xff, 0xff, 0xff})
+			},
+			want: []float64{0},
+		},
+		{
+			name: "replay after checkpoint",
+			damage: func(t *testing.T, s *spool, _ string) {
+				_, position, _, err := s.load(1, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.advance(position)
+				if err = s.commit(); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []float64{1, 2},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := openSpool(dir, "processor")
+			if err != nil {
+				t.Fatal(err)
+			}
+			record := func(id int) batchRecord {
+				return batchRecord{routeID: "route", data: models.Data{"id": float64(id)}, ingestedAt: time.Now().UTC()}
+			}
+			if err = s.append([]batchRecord{record(0), record(1), record(2)}); err != nil {
+				t.Fatal(err)
+			}
+			test.damage(t, s, s.segmentPath(s.active().seq))
+
+			// the spool resumes after its last valid entry, appends follow it
+			reopened, err := openSpool(dir, "processor")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = reopened.append([]batchRecord{record(3)}); err != nil {
+				t.Fatal(err)
+			}
+			replayed, _, _, err := reopened.load(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []float64
+			for _, record := range replayed {
+				ids = append(ids, record.data["id"].(float64))
+			}
+			if want := append(test.want, 3); !reflect.DeepEqual(ids, want) {
+				t.Errorf("replayed ids %v, want %v", ids, want)
+			}
+		})
+	}
+}
@@ -2,66 +2,313 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
 	"github.com/quantumwake/alethic-ism-core-go/pkg/repository/processor"
-	"github.com/quantumwake/alethic-ism-core-go/pkg/repository/processor/tables"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/routing"
+	"gorm.io/gorm"
 )
 
 // BatchWriter handles batched inserts to a database table with automatic flushing based on size and time thresholds
 type BatchWriter struct {
-	config    *tables.TableProcessorConfig
+	config    *TableConfig
 	tableName string
 
-	mu         sync.Mutex
-	batch      []models.Data   // Current batch of records waiting to be inserted
-	routeIDs   map[string]bool // Track unique routes in current batch for status publishing
-	lastFlush  time.Time       // When we last flushed the batch
-	lastUsed   time.Time       // Track for cleanup of idle managers
-	tableReady bool            // Whether the table has been created
-	stopFlush  chan struct{}   // Signal to stop background flush goroutine
+	mu            sync.Mutex
+	batch         []batchRecord                // Current batch of records waiting to be inserted
+	messages      []routing.MessageEnvelop     // Messages backing the current batch, acked only once the batch is flushed
+	routes        map[string]*routeBatch       // Records of each route in the current batch, for status publishing
+	lastFlush     time.Time                    // When we last flushed the batch
+	claimed       bool                         // Whether the table has been claimed in the catalog, deferred to the first write during an outage
+	tableReady    bool                         // Whether the table has been created
+	columns       map[string]ColumnType        // Columns known to exist in the table, with their types
+	keyIndexReady bool                         // Whether the key index (or history columns and indexes) has been created
+	columnNames   map[string]string            // Column name of each record key, as registered in the catalog
+	columnKeys    map[string]string            // Record key of each column name, to detect keys normalizing to the same name
+	flushTicker   *time.Ticker                 // Drives the background flush, stopped when time based flushing is disabled
+	stopFlush     chan struct{}                // Signal to stop background flush goroutine
+	flushDone     chan struct{}                // Closed once the background flush goroutine has returned
+	stopOnce      sync.Once                    // Stop is idempotent
+	closed        bool                         // Whether the writer has been stopped, records are no longer accepted
+	refs          atomic.Int32                 // Leases held on the writer, a leased writer is never evicted
+	lastUsed      atomic.Int64                 // When the writer was last used (unix nanoseconds), read by cleanup without the lock
+	running       atomic.Pointer[runningFlush] // The flush in progress, read by the liveness probe without the lock
+
+	bufferedRecords int64  // Records reserved in the buffer by the current batch
+	bufferedBytes   int64  // Approximate bytes reserved in the buffer by the current batch
+	spool           *spool // Records spooled to disk, every record when the spool is enabled or else those spilled while the buffer was full, nil without a spool or spill directory
 }
 
-// NewBatchWriter creates a new BatchWriter for a specific processor with the given configuration
-func NewBatchWriter(processorID string, config *tables.TableProcessorConfig) *BatchWriter {
-	var tableName string
-	if config.TableName != nil {
-		tableName = FormatTableName(processorID, *config.TableName)
-	} else {
-		tableName = FormatTableName(processorID, "")
+// batchRecord is a record waiting to be inserted, along with the route it was ingested from
+type batchRecord struct {
+	routeID    string
+	data       models.Data // the record as ingested, keyed by record key
+	row        models.Data // the record keyed by column name, resolved when the batch is written
+	ingestedAt time.Time
+	size       int64 // approximate bytes of the record, its share of the message it was ingested from
+}
+
+// runningFlush records when the flush of a table started
+type runningFlush struct {
+	table   string
+	started time.Time
+}
+
+// routeBatch accounts for the records a route contributed to the current batch
+type routeBatch struct {
+	records         int
+	bytes           int64
+	firstIngestedAt time.Time
+	lastIngestedAt  time.Time
+}
+
+// summary returns the accounting of the route's records, rows is the number of them written to the table
+func (r *routeBatch) summary(table string, rows int) RouteFlushSummary {
+	return RouteFlushSummary{
+		Table:           table,
+		Rows:            rows,
+		Records:         r.records,
+		Bytes:           r.bytes,
+		FirstIngestedAt: r.firstIngestedAt,
+		LastIngestedAt:  r.lastIngestedAt,
+	}
+}
+
+// quarantinedRecord is a record the database refused to insert, along with the reason
+type quarantinedRecord struct {
+	batchRecord
+	err error
+}
+
+// writeResult is the outcome of writing a batch
+type writeResult struct {
+	written     []batchRecord       // records written, including those dropped on conflict per the write mode
+	changed     []batchRecord       // records written that inserted or changed a row, forwarded downstream
+	quarantined []quarantinedRecord // records refused by the database, stored in the quarantine table
+	rows        map[string]int64    // rows inserted or updated per route
+}
+
+// registerTable claims a table in the catalog and writeBatch writes the batch of a writer, replaced in tests to run
+// writers without a database
+var (
+	registerTable = RegisterTable
+	writeBatch    = (*BatchWriter).write
+)
+
+// NewBatchWriter creates a new BatchWriter for a specific processor with the given configuration, claiming the
+// configured table for the processor in the catalog. With the spool enabled, a writer created while the database is
+// unreachable claims its table on its first write instead, such that its records are spooled throughout the outage.
+func NewBatchWriter(processorID string, config *TableConfig) (*BatchWriter, error) {
+	tableName := config.Table()
+	claimed := false
+	if !dbBreaker.Open() || !spoolEnabled() {
+		err := registerTable(tableName, processorID, config.ProjectID)
+		if err != nil && !(spoolEnabled() && isConnectionError(err)) {
+			return nil, err
+		}
+		claimed = err == nil
 	}
 
 	writer := &BatchWriter{
 		config:    config,
 		tableName: tableName,
-		batch:     make([]models.Data, 0),
-		routeIDs:  make(map[string]bool),
+		batch:     make([]batchRecord, 0),
+		messages:  make([]routing.MessageEnvelop, 0),
+		routes:    make(map[string]*routeBatch),
 		lastFlush: time.Now(),
-		lastUsed:  time.Now(),
 		stopFlush: make(chan struct{}),
+		flushDone: make(chan struct{}),
+		claimed:   claimed,
 	}
+	writer.lastUsed.Store(time.Now().UnixNano())
 
-	// Start background flush goroutine if time-based batching is configured
-	if config.BatchWindowTTL != nil && *config.BatchWindowTTL >= 5 {
-		go writer.backgroundFlush(time.Duration(*config.BatchWindowTTL) * time.Second)
+	// Resume the records spooled before a restart
+	dir := spillDir
+	if spoolEnabled() {
+		dir = spoolDir
 	}
+	if dir != "" {
+		spool, err := openSpool(dir, processorID)
+		if err != nil {
+			return nil, err
+		}
+		writer.spool = spool
+		writer.loadSpooled()
+	}
+
+	// The background flush runs for the lifetime of the writer, such that a reconfigured batch window only resets
+	// its ticker
+	writer.flushTicker = time.NewTicker(time.Hour)
+	writer.resetFlushTicker()
+	go writer.backgroundFlush(ackProgressInterval)
 
-	return writer
+	return writer, nil
 }
 
-// Add appends records to the batch and flushes if size threshold is reached
-func (bw *BatchWriter) Add(routeID string, records []models.Data) error {
+// Reconfigure applies a changed processor configuration. The pending records are flushed under the configuration
+// they were added with, and the table is re-resolved on the next flush since the table name, schema or write mode may
+// have changed. A configuration whose table is owned by another processor is refused and the current one kept.
+func (bw *BatchWriter) Reconfigure(config *TableConfig) error {
 	bw.mu.Lock()
 	defer bw.mu.Unlock()
 
-	bw.lastUsed = time.Now()
-	bw.routeIDs[routeID] = true
+	if config.Version() == bw.config.Version() {
+		return nil
+	}
+
+	moved := config.Table() != bw.tableName
+	if moved {
+		if err := registerTable(config.Table(), config.ProcessorID, config.ProjectID); err != nil {
+			return err
+		}
+	}
+
+	// a failed flush has already settled its messages for redelivery, which will be written under the new configuration
+	if err := bw.flush(); err != nil {
+		log.Printf("error flushing table %s before reconfiguring: %v\n", bw.tableName, err)
+	}
+
+	log.Printf("reconfiguring writer of table %s, now writing to table %s\n", bw.tableName, config.Table())
+	bw.config = config
+	bw.tableName = config.Table()
+	bw.claimed = bw.claimed || moved
+	bw.resetTableState()
+	bw.resetFlushTicker()
+	return nil
+}
+
+// resetTableState forgets what is known about the table, such that the next flush reads its columns and names
+// again and ensures its indexes (must be called with lock held)
+func (bw *BatchWriter) resetTableState() {
+	bw.tableReady = false
+	bw.columns = nil
+	bw.keyIndexReady = false
+	bw.columnNames = nil
+	bw.columnKeys = nil
+}
+
+// resetFlushTicker restarts the background flush ticker with the configured batch window, or stops it when time
+// based flushing is disabled. With the spool enabled the ticker keeps replaying the spool, such that records spooled
+// during a database outage are written once it recovers (must be called with lock held)
+func (bw *BatchWriter) resetFlushTicker() {
+	switch window, enabled := bw.config.FlushWindow(); {
+	case enabled:
+		bw.flushTicker.Reset(window)
+	case spoolEnabled():
+		bw.flushTicker.Reset(spoolReplayInterval)
+	default:
+		bw.flushTicker.Stop()
+	}
+}
+
+// Add appends records to the batch and flushes if size threshold is reached. The writer takes ownership of
+// the message, acknowledging it once its records are durably flushed (or spooled) or negatively acknowledging it on
+// failure. ErrWriterClosed is returned, without taking ownership of the message, once the writer has been stopped. When the
+// writer or global buffer is full the configured backpressure policy applies: the callback is blocked until there
+// is room, the records are spilled to disk, or ErrBufferFull is returned such that the message is redelivered. A
+// blocked callback gives up with ErrShuttingDown once the intake is closed.
+func (bw *BatchWriter) Add(msg routing.MessageEnvelop, routeID string, records []models.Data, size int64) error {
+	timeout := time.NewTimer(backpressureBlockTimeout)
+	defer timeout.Stop()
 
+	for {
+		// taken before trying, such that room released in between is not missed
+		released := globalBuffer.waitRelease()
+
+		added, err := bw.tryAdd(msg, routeID, records, size)
+		if added || err != nil {
+			return err
+		}
+
+		// make room by flushing this writer, and wait for room released by any writer
+		go func() {
+			if err := bw.Flush(); err != nil {
+				log.Printf("error flushing full batch writer: %v\n", err)
+			}
+		}()
+
+		select {
+		case <-released:
+		case <-timeout.C:
+			return fmt.Errorf("%w: table %s: no room within %s", ErrBufferFull, bw.Table(), backpressureBlockTimeout)
+		case <-intakeClosing():
+			return fmt.Errorf("%w: no room in the buffer before the intake closed", ErrShuttingDown)
+		}
+	}
+}
+
+// tryAdd adds the records when the buffers have room for them, or else applies the spill or nak backpressure
+// policy. It returns false without an error when the caller should block until there is room.
+func (bw *BatchWriter) tryAdd(msg routing.MessageEnvelop, routeID string, records []models.Data, size int64) (bool, error) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	if bw.closed {
+		return false, ErrWriterClosed
+	}
+	bw.lastUsed.Store(time.Now().UnixNano())
+
+	policy := bw.config.BackpressurePolicy()
+	count := int64(len(records))
+
+	// every record goes through the spool when enabled, and once records are spilled later records follow them
+	// through the spool to keep them in order
+	spooling := spoolEnabled() || (policy == BackpressureSpill && bw.spool.backlog() > 0)
+	if spooling {
+		return true, bw.spoolRecords(msg, routeID, bw.prepare(routeID, records))
+	}
+
+	if bw.reserve(count, size) {
+		bw.add(msg, routeID, bw.prepare(routeID, records), size)
+		return true, nil
+	}
+
+	// without a spill directory the spill policy redelivers the message, as the nak policy does
+	switch {
+	case policy == BackpressureSpill && bw.spool != nil:
+		return true, bw.spoolRecords(msg, routeID, bw.prepare(routeID, records))
+	case policy == BackpressureSpill, policy == BackpressureNak:
+		stats := bw.stats()
+		return false, fmt.Errorf("%w: table %s holds %d records (%d bytes)", ErrBufferFull, bw.tableName, stats.Records, stats.Bytes)
+	}
+	return false, nil
+}
+
+// reserve reserves room for the records in the writer and global buffers (must be called with lock held)
+func (bw *BatchWriter) reserve(records int64, bytes int64) bool {
+	maxRecords, maxBytes := bw.config.BufferLimits()
+	if !withinLimits(bw.bufferedRecords, bw.bufferedBytes, records, bytes, maxRecords, maxBytes) {
+		return false
+	}
+	if !globalBuffer.tryReserve(records, bytes) {
+		return false
+	}
+	bw.bufferedRecords += records
+	bw.bufferedBytes += bytes
+	observeBuffered(bw.config.ProcessorID, bw.tableName, records, bytes)
+	return true
+}
+
+// releaseBuffer returns the room reserved by the batch to the global buffer (must be called with lock held)
+func (bw *BatchWriter) releaseBuffer() {
+	globalBuffer.release(bw.bufferedRecords, bw.bufferedBytes)
+	observeBuffered(bw.config.ProcessorID, bw.tableName, -bw.bufferedRecords, -bw.bufferedBytes)
+	bw.bufferedRecords, bw.bufferedBytes = 0, 0
+}
+
+// prepare adds the timestamp to the records and drops the records not conforming to the configuration (must be
+// called with lock held)
+func (bw *BatchWriter) prepare(routeID string, records []models.Data) []models.Data {
 	// Add timestamp to each record if configured
-	if bw.config.IncludeTimestamp != nil && *bw.config.IncludeTimestamp {
+	if bw.config.IncludesTimestamp() {
 		timestamp := time.Now().UTC().Format(time.RFC3339)
 		for i := range records {
 			if records[i] == nil {
@@ -71,20 +318,188 @@ func (bw *BatchWriter) Add(routeID string, records []models.Data) error {
 		}
 	}
 
-	bw.batch = append(bw.batch, records...)
+	// Generate a row id for each record if configured, such that forwarded records can be related to their rows
+	if bw.config.IncludesRowID() {
+		for i := range records {
+			if records[i] == nil {
+				records[i] = make(models.Data)
+			}
+			records[i]["_row_id"] = uuid.NewString()
+		}
+	}
+
+	// Version columns are maintained by the history mode, never taken from records
+	if bw.config.Mode() == WriteModeHistory {
+		for _, record := range records {
+			for column := range historyColumns {
+				delete(record, column)
+			}
+		}
+	}
+
+	// Records must conform to the declared schema, if any
+	if bw.config.HasSchema() {
+		records = bw.conform(routeID, records)
+	}
+
+	// Records must carry their keys, unless appended
+	if bw.config.Mode() != WriteModeAppend && len(bw.config.Keys()) > 0 {
+		records = bw.requireKeys(routeID, records)
+	}
+	return records
+}
+
+// add appends the prepared records to the batch, and flushes asynchronously once the batch size is reached (must
+// be called with lock held)
+func (bw *BatchWriter) add(msg routing.MessageEnvelop, routeID string, records []models.Data, size int64) {
+	bw.messages = append(bw.messages, msg)
+
+	ingestedAt := time.Now().UTC()
+	for _, record := range records {
+		added := batchRecord{routeID: routeID, data: record, ingestedAt: ingestedAt, size: size / int64(len(records))}
+		bw.trackRoute(added)
+		bw.batch = append(bw.batch, added)
+	}
+
+	bw.flushIfFull()
+}
 
+// trackRoute accounts for a record accepted into the batch, publishing a running status when its route joins the
+// batch (must be called with lock held)
+func (bw *BatchWriter) trackRoute(record batchRecord) {
+	route, exists := bw.routes[record.routeID]
+	if !exists {
+		route = &routeBatch{firstIngestedAt: record.ingestedAt}
+		bw.routes[record.routeID] = route
+		PublishRouteStatus(context.Background(), record.routeID, processor.Running, "", nil)
+	}
+
+	route.records++
+	route.bytes += record.size
+	if record.ingestedAt.Before(route.firstIngestedAt) {
+		route.firstIngestedAt = record.ingestedAt
+	}
+	if record.ingestedAt.After(route.lastIngestedAt) {
+		route.lastIngestedAt = record.ingestedAt
+	}
+}
+
+// flushIfFull flushes asynchronously once the batch reaches the configured batch size (must be called with lock
+// held)
+func (bw *BatchWriter) flushIfFull() {
 	// Flush if we've reached the configured batch size
 	// TODO: Make async flush configurable via processor properties flag
 	if bw.config.BatchSize != nil && len(bw.batch) >= *bw.config.BatchSize {
 		go func() {
-			err := bw.Flush()
-			if err != nil {
-				fmt.Printf("error flushing batch writer: %v\n", err)
+			if err := bw.Flush(); err != nil {
+				log.Printf("error flushing table %s: %v\n", bw.Table(), err)
 			}
 		}()
 	}
+}
 
-	return nil
+// conform checks the records against the declared columns, records that do not conform are dropped and reported
+// as a failure on their route (must be called with lock held)
+func (bw *BatchWriter) conform(routeID string, records []models.Data) []models.Data {
+	columns := bw.config.ColumnDefinitions()
+	policy := SchemaPolicyCoerce
+	if bw.config.SchemaPolicy != nil {
+		policy = *bw.config.SchemaPolicy
+	}
+
+	return bw.filter(routeID, records, func(record models.Data) (models.Data, []string) {
+		return ConformRecord(record, columns, policy)
+	})
+}
+
+// requireKeys drops the records missing a value for any key column, such records can never be matched to the
+// row they should replace (must be called with lock held)
+func (bw *BatchWriter) requireKeys(routeID string, records []models.Data) []models.Data {
+	keys := bw.config.Keys()
+	return bw.filter(routeID, records, func(record models.Data) (models.Data, []string) {
+		var violations []string
+		for _, key := range keys {
+			if record[key] == nil {
+				violations = append(violations, fmt.Sprintf("key column %q is required", key))
+			}
+		}
+		return record, violations
+	})
+}
+
+// filter applies the check to each record, records with violations are dropped and reported as a failure on their
+// route (must be called with lock held)
+func (bw *BatchWriter) filter(routeID string, records []models.Data, check func(models.Data) (models.Data, []string)) []models.Data {
+	accepted := make([]models.Data, 0, len(records))
+	var rejected []models.Data
+	var notes []string
+	for i, record := range records {
+		result, violations := check(record)
+		if len(violations) > 0 {
+			rejected = append(rejected, record)
+			notes = append(notes, fmt.Sprintf("record %d: %s", i, strings.Join(violations, "; ")))
+			continue
+		}
+		accepted = append(accepted, result)
+	}
+
+	if len(rejected) > 0 {
+		note := fmt.Sprintf("%d of %d records rejected by table %s: %s",
+			len(rejected), len(records), bw.tableName, strings.Join(notes, ", "))
+		PublishRouteStatus(context.Background(), routeID, processor.Failed, note, rejected)
+	}
+
+	return accepted
+}
+
+// insertOptions returns how conflicting rows are resolved, per the configured write mode (must be called with lock
+// held)
+func (bw *BatchWriter) insertOptions() InsertOptions {
+	return InsertOptions{Mode: bw.config.Mode(), Keys: bw.columnList(bw.config.Keys())}
+}
+
+// deduplicate keeps a single record for each key: the last one when keepLast, such that the last writer within a
+// batch wins, or else the first one as a single insert ignoring conflicts keeps (must be called with lock held)
+func (bw *BatchWriter) deduplicate(records []batchRecord, keepLast bool) []batchRecord {
+	keys := bw.config.Keys()
+	index := make(map[string]int, len(records))
+	deduplicated := make([]batchRecord, 0, len(records))
+	for _, record := range records {
+		identity := bw.recordIdentity(keys, record.data)
+		if i, exists := index[identity]; exists {
+			if keepLast {
+				deduplicated[i] = record
+			}
+			continue
+		}
+		index[identity] = len(deduplicated)
+		deduplicated = append(deduplicated, record)
+	}
+	return deduplicated
+}
+
+// recordIdentity returns a comparable identity of the record's key values, as bound to their columns (must be
+// called with lock held)
+func (bw *BatchWriter) recordIdentity(keys []string, record models.Data) string {
+	return hashValues(bw.keyValues(keys, record))
+}
+
+// keyValues returns the key column values of a record, as bound to their columns (must be called with lock held)
+func (bw *BatchWriter) keyValues(keys []string, record models.Data) []any {
+	values := make([]any, len(keys))
+	for i, key := range keys {
+		values[i] = bw.boundValue(key, record[key])
+	}
+	return values
+}
+
+// boundValue returns the value of a record key as bound to its column, or the value itself when it does not convert
+// (must be called with lock held)
+func (bw *BatchWriter) boundValue(key string, value any) any {
+	if converted, err := ConvertValue(bw.columns[bw.column(key)], value); err == nil {
+		return converted
+	}
+	return value
 }
 
 // Flush forces an immediate flush of the current batch
@@ -96,68 +511,632 @@ func (bw *BatchWriter) Flush() error {
 
 // flush performs the actual database operations (must be called with lock held)
 func (bw *BatchWriter) flush() error {
-	if len(bw.batch) == 0 {
+	// replay the spooled records the buffer has room for
+	bw.loadSpooled()
+
+	if len(bw.messages) == 0 && len(bw.batch) == 0 {
 		return nil
 	}
 
-	// Create table on first flush using the schema from the first record
-	if !bw.tableReady && len(bw.batch) > 0 {
-		if err := bw.ensureTable(bw.batch[0]); err != nil {
+	start := time.Now()
+	bw.running.Store(&runningFlush{table: bw.tableName, started: start})
+	defer bw.running.Store(nil)
+	var attempts int64
+	var result writeResult
+	err := withRetry(func() (err error) {
+		attempts++
+		result, err = writeBatch(bw)
+		return err
+	})
+	duration := time.Since(start)
+	observeFlush(bw.config.ProcessorID, bw.tableName, len(bw.batch), duration, err)
+	bw.publishFlushSummary(result, duration, max(attempts-1, 0), err)
+	if err != nil {
+		// the routes held back by an unavailable database are reported as degraded until it is available again,
+		// otherwise each route is failed with the error
+		degraded := errors.Is(err, ErrCircuitOpen) || dbBreaker.Open()
+		for routeID, route := range bw.routes {
+			if degraded {
+				dbBreaker.degrade(routeID)
+				continue
+			}
+			PublishStatusUpdateWithErrorMsg(context.Background(), routeID, route.summary(bw.tableName, 0), err)
+		}
+
+		// none of the records were written, records the database refused are quarantined rather than failing the
+		// flush, so every message is redelivered and the batch dropped rather than inserting its records twice.
+		// Spooled records remain in the spool and are replayed
+		bw.nakMessages()
+		bw.spool.rollback()
+		bw.reset()
+		return err
+	}
+
+	if err = bw.spool.commit(); err != nil {
+		log.Printf("error committing spooled records of table %s: %v\n", bw.tableName, err)
+	}
+
+	// Acknowledge the messages only now that their records are committed (or quarantined)
+	bw.ackMessages()
+
+	// Publish a failure for each route with quarantined records, and completion with the rows written for the
+	// remaining routes
+	failedRoutes := bw.publishQuarantined(result)
+	for routeID, route := range bw.routes {
+		if !failedRoutes[routeID] {
+			PublishRouteStatus(context.Background(), routeID, processor.Completed, "", route.summary(bw.tableName, int(result.rows[routeID])))
+		}
+	}
+
+	// Forward the records that changed the table downstream, if configured
+	bw.forward(result.changed)
+
+	bw.reset()
+	bw.loadSpooled()
+	return nil
+}
+
+// spoolRecords appends the prepared records to the spool and acknowledges the message once they are synced to disk.
+// The records are loaded into the batch as the buffer has room for them (must be called with lock held)
+func (bw *BatchWriter) spoolRecords(msg routing.MessageEnvelop, routeID string, records []models.Data) error {
+	ingestedAt := time.Now().UTC()
+	spooled := make([]batchRecord, len(records))
+	for i, record := range records {
+		spooled[i] = batchRecord{routeID: routeID, data: record, ingestedAt: ingestedAt}
+	}
+
+	if err := bw.spool.append(spooled); err != nil {
+		return fmt.Errorf("%w of table %s: %w", ErrSpoolWrite, bw.tableName, err)
+	}
+
+	if err := msg.Ack(context.Background()); err != nil {
+		log.Printf("error acking spooled message: %v\n", err)
+	}
+
+	bw.loadSpooled()
+	bw.flushIfFull()
+	return nil
+}
+
+// loadSpooled loads spooled records into the batch, as far as the buffer has room for them. The records are
+// consumed from the spool once the batch holding them is flushed (must be called with lock held)
+func (bw *BatchWriter) loadSpooled() {
+	if bw.spool == nil || (bw.spool.pending == bw.spool.checkpoint && bw.spool.backlog() == 0) {
+		return
+	}
+
+	maxRecords, maxBytes := bw.config.BufferLimits()
+	if !withinLimits(bw.bufferedRecords, bw.bufferedBytes, 1, 1, maxRecords, maxBytes) {
+		return
+	}
+	records, position, size, err := bw.spool.load(max(maxRecords-bw.bufferedRecords, 0), max(maxBytes-bw.bufferedBytes, 0))
+	if err != nil {
+		log.Printf("error loading spooled records of table %s: %v\n", bw.tableName, err)
+		return
+	}
+	if len(records) == 0 {
+		bw.spool.advance(position) // past any corrupt entries
+		return
+	}
+
+	// the global buffer may be full, spooled records then wait for the next flush
+	if !bw.reserve(int64(len(records)), size) {
+		return
+	}
+	bw.spool.advance(position)
+
+	for _, record := range records {
+		bw.trackRoute(record)
+	}
+	bw.batch = append(bw.batch, records...)
+}
+
+// Table returns the name of the table the writer writes to
+func (bw *BatchWriter) Table() string {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	return bw.tableName
+}
+
+// Info returns a snapshot of the writer and the configuration in effect
+func (bw *BatchWriter) Info() WriterInfo {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	return WriterInfo{
+		ProcessorID:     bw.config.ProcessorID,
+		Table:           bw.tableName,
+		PendingRecords:  len(bw.batch),
+		PendingMessages: len(bw.messages),
+		Buffer:          bw.stats(),
+		LastFlush:       bw.lastFlush,
+		LastUsed:        bw.LastUsed(),
+		Leases:          bw.refs.Load(),
+		Config:          bw.config,
+	}
+}
+
+// stats returns a snapshot of the records buffered by the writer (must be called with lock held)
+func (bw *BatchWriter) stats() BufferStats {
+	maxRecords, maxBytes := bw.config.BufferLimits()
+	return BufferStats{
+		ProcessorID:  bw.config.ProcessorID,
+		Table:        bw.tableName,
+		Records:      bw.bufferedRecords,
+		Bytes:        bw.bufferedBytes,
+		Messages:     int64(len(bw.messages)),
+		MaxRecords:   maxRecords,
+		MaxBytes:     maxBytes,
+		SpooledBytes: bw.spool.backlog(),
+	}
+}
+
+// write inserts the current batch into the table in a single transaction, creating the table on first use. When
+// the database refuses the batch, the batch is bisected to isolate the offending records which are quarantined
+// within the same transaction, such that the remaining records are committed exactly once. A transient error rolls
+// back the whole batch (must be called with lock held).
+func (bw *BatchWriter) write() (writeResult, error) {
+	if len(bw.batch) == 0 {
+		return writeResult{}, nil
+	}
+
+	// Claim the table of a writer created while the database was unreachable
+	if !bw.claimed {
+		if err := registerTable(bw.tableName, bw.config.ProcessorID, bw.config.ProjectID); err != nil {
+			return writeResult{}, err
+		}
+		bw.claimed = true
+	}
+
+	// Resolve the column name of every key in the batch, and key the records by column name
+	if err := bw.resolveColumns(append(RecordKeys(batchData(bw.batch)), bw.config.ColumnKeys()...)); err != nil {
+		return writeResult{}, err
+	}
+	for i := range bw.batch {
+		bw.batch[i].row = bw.toRow(bw.batch[i].data)
+	}
+
+	// Create or evolve the table such that every key in the batch has a column
+	if err := bw.ensureTable(batchRows(bw.batch)); err != nil {
+		return writeResult{}, err
+	}
+
+	db, err := GetDB()
+	if err != nil {
+		return writeResult{}, err
+	}
+
+	// A single record per key is written, such that inserting each route on its own (see insert) writes the same
+	// records as a single insert would
+	records := bw.batch
+	switch mode := bw.config.Mode(); {
+	case mode == WriteModeUpsert:
+		records = bw.deduplicate(records, true)
+	case mode == WriteModeInsertIgnore && len(bw.config.Keys()) > 0:
+		records = bw.deduplicate(records, false)
+	}
+
+	var result writeResult
+	err = db.Transaction(func(tx *gorm.DB) error {
+		result = writeResult{rows: make(map[string]int64)} // the transaction func may be re-entered on a fresh transaction
+		if err := bw.insertIsolating(tx, records, &result); err != nil {
 			return err
 		}
-		bw.tableReady = true
+		return bw.quarantine(tx, result.quarantined)
+	})
+	if err != nil {
+		return writeResult{}, fmt.Errorf("failed to insert records: %w", err)
 	}
+	return result, nil
+}
+
+// insertIsolating inserts the records within a savepoint, on a non-transient failure the records are split in
+// half and each half retried until the offending records are isolated (must be called with lock held)
+func (bw *BatchWriter) insertIsolating(tx *gorm.DB, records []batchRecord, result *writeResult) error {
+	var rows map[string]int64
+	var changed []batchRecord
+	err := tx.Transaction(func(sp *gorm.DB) (err error) {
+		rows, changed, err = bw.insert(sp, records)
+		return err
+	})
 
-	// Insert all records in the batch
-	for _, record := range bw.batch {
-		if err := InsertRecord(bw.tableName, record); err != nil {
-			return fmt.Errorf("failed to insert record: %w", err)
+	switch {
+	case err == nil:
+		result.written = append(result.written, records...)
+		result.changed = append(result.changed, changed...)
+		for routeID, n := range rows {
+			result.rows[routeID] += n
 		}
+		return nil
+	case IsTransientError(err):
+		return err
+	case len(records) == 1:
+		result.quarantined = append(result.quarantined, quarantinedRecord{batchRecord: records[0], err: err})
+		return nil
 	}
 
-	// Publish completion status for each route in the batch
-	for routeID := range bw.routeIDs {
-		PublishRouteStatus(context.Background(), routeID, processor.Completed, "", nil)
+	mid := len(records) / 2
+	if err = bw.insertIsolating(tx, records[:mid], result); err != nil {
+		return err
+	}
+	return bw.insertIsolating(tx, records[mid:], result)
+}
+
+// insert writes the records per the configured write mode, returning the rows inserted or updated per route and the
+// records that inserted or changed a row. Every appended record inserts a row, whereas upserted or ignored records
+// may leave the table unchanged: their routes are inserted one by one to attribute the rows affected, and the records
+// of a route are only considered changed when any of them affected a row (must be called with lock held)
+func (bw *BatchWriter) insert(tx *gorm.DB, records []batchRecord) (map[string]int64, []batchRecord, error) {
+	rows := make(map[string]int64)
+	switch bw.config.Mode() {
+	case WriteModeHistory:
+		return bw.writeHistory(tx, records)
+	case WriteModeAppend:
+		if _, err := InsertRecords(tx, bw.tableName, batchRows(records), bw.columns, bw.insertOptions()); err != nil {
+			return nil, nil, err
+		}
+		for _, record := range records {
+			rows[record.routeID]++
+		}
+		return rows, records, nil
 	}
 
-	// Reset batch, routeIDs, and update flush time
+	var changed []batchRecord
+	for _, route := range groupByRoute(records) {
+		affected, err := InsertRecords(tx, bw.tableName, batchRows(route), bw.columns, bw.insertOptions())
+		if err != nil {
+			return nil, nil, err
+		}
+		rows[route[0].routeID] += affected
+		if affected > 0 {
+			changed = append(changed, route...)
+		}
+	}
+	return rows, changed, nil
+}
+
+// quarantine stores the records refused by the database, with their error, in the quarantine table (must be called
+// with lock held)
+func (bw *BatchWriter) quarantine(tx *gorm.DB, quarantined []quarantinedRecord) error {
+	if len(quarantined) == 0 {
+		return nil
+	}
+
+	quarantineTable := QuarantineTableName(bw.tableName)
+	if err := CreateQuarantineTable(tx, quarantineTable); err != nil {
+		return fmt.Errorf("failed to create quarantine table %s: %w", quarantineTable, err)
+	}
+
+	for _, record := range quarantined {
+		if err := InsertQuarantinedRecord(tx, quarantineTable, record.routeID, record.data, record.err); err != nil {
+			return fmt.Errorf("failed to quarantine record: %w", err)
+		}
+	}
+
+	log.Printf("quarantined %d records refused by table %s\n", len(quarantined), bw.tableName)
+	return nil
+}
+
+// publishFlushSummary publishes the outcome of a flush of the current batch, batches without records are not
+// reported (must be called with lock held)
+func (bw *BatchWriter) publishFlushSummary(result writeResult, duration time.Duration, retries int64, err error) {
+	if len(bw.batch) == 0 {
+		return
+	}
+
+	var rows int64
+	for _, n := range result.rows {
+		rows += n
+	}
+
+	summary := FlushSummary{
+		ProcessorID: bw.config.ProcessorID,
+		Table:       bw.tableName,
+		Rows:        int(rows),
+		Quarantined: len(result.quarantined),
+		Routes:      len(bw.routes),
+		DurationMs:  duration.Milliseconds(),
+		Retries:     retries,
+	}
+	if err != nil {
+		summary.Rows, summary.Quarantined = 0, 0
+	}
+	PublishFlushSummary(context.Background(), summary, err)
+}
+
+// publishQuarantined publishes a failure, with the database errors, for each route with quarantined records and
+// returns the set of failed routes (must be called with lock held)
+func (bw *BatchWriter) publishQuarantined(result writeResult) map[string]bool {
+	byRoute := make(map[string][]quarantinedRecord)
+	for _, record := range result.quarantined {
+		byRoute[record.routeID] = append(byRoute[record.routeID], record)
+	}
+
+	failedRoutes := make(map[string]bool, len(byRoute))
+	for routeID, records := range byRoute {
+		notes := make([]string, 0, len(records))
+		data := make([]models.Data, 0, len(records))
+		for _, record := range records {
+			notes = append(notes, record.err.Error())
+			data = append(data, record.data)
+		}
+
+		note := fmt.Sprintf("%d records quarantined to table %s, %d rows written: %s",
+			len(records), QuarantineTableName(bw.tableName), result.rows[routeID],
+			strings.Join(notes, "; "))
+		PublishRouteStatus(context.Background(), routeID, processor.Failed, note, data)
+		failedRoutes[routeID] = true
+	}
+	return failedRoutes
+}
+
+// batchData returns the data of the batch records
+func batchData(records []batchRecord) []models.Data {
+	data := make([]models.Data, len(records))
+	for i, record := range records {
+		data[i] = record.data
+	}
+	return data
+}
+
+// batchRows returns the records of the batch keyed by column name
+func batchRows(records []batchRecord) []models.Data {
+	rows := make([]models.Data, len(records))
+	for i, record := range records {
+		rows[i] = record.row
+	}
+	return rows
+}
+
+// groupByRoute splits the records per route, routes in the order of their first record and records in batch order
+func groupByRoute(records []batchRecord) [][]batchRecord {
+	var groups [][]batchRecord
+	index := make(map[string]int)
+	for _, record := range records {
+		i, exists := index[record.routeID]
+		if !exists {
+			i = len(groups)
+			index[record.routeID] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], record)
+	}
+	return groups
+}
+
+// reset clears the batch, messages and routes, releases the room they reserved in the buffer and updates the flush
+// time (must be called with lock held)
+func (bw *BatchWriter) reset() {
+	bw.releaseBuffer()
 	bw.batch = bw.batch[:0]
-	bw.routeIDs = make(map[string]bool)
+	bw.messages = bw.messages[:0]
+	bw.routes = make(map[string]*routeBatch)
 	bw.lastFlush = time.Now()
+}
+
+// ackMessages acknowledges every message backing the current batch (must be called with lock held)
+func (bw *BatchWriter) ackMessages() {
+	for _, msg := range bw.messages {
+		if err := msg.Ack(context.Background()); err != nil {
+			log.Printf("error acking message after flush: %v\n", err)
+		}
+	}
+}
+
+// progressMessages reports every message backing the current batch in progress
+func (bw *BatchWriter) progressMessages() {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	for _, msg := range bw.messages {
+		progressMessage(msg)
+	}
+}
+
+// nakMessages negatively acknowledges every message backing the current batch after a failed flush, such that it is
+// redelivered with backoff regardless of the error: a failed flush wrote none of its records (must be called with
+// lock held)
+func (bw *BatchWriter) nakMessages() {
+	for _, msg := range bw.messages {
+		nakMessage(context.Background(), msg, NakBackoff(msg))
+	}
+}
+
+// ensureTable creates the table if it doesn't exist with column types inferred across the batch (or declared), adds
+// a column for any key not yet known to the table, widens columns whose values no longer fit and creates the unique
+// index over the key columns (must be called with lock held)
+func (bw *BatchWriter) ensureTable(records []models.Data) error {
+	if err := bw.ensureColumns(records); err != nil {
+		return err
+	}
+
+	if bw.keyIndexReady {
+		return nil
+	}
+
+	switch mode := bw.config.Mode(); {
+	case mode == WriteModeHistory:
+		// versions are tracked in their own columns, with a single current version per key
+		if err := EnsureHistoryColumns(bw.tableName, bw.columnList(bw.config.Keys())); err != nil {
+			return fmt.Errorf("failed to create history columns on table %s: %w", bw.tableName, err)
+		}
+		for column, columnType := range historyColumns {
+			bw.columns[column] = columnType
+		}
+	case mode != WriteModeAppend && len(bw.config.Keys()) > 0:
+		// conflicts are detected on a unique index over the key columns
+		if err := CreateUniqueIndex(bw.tableName, bw.columnList(bw.config.Keys())); err != nil {
+			return fmt.Errorf("failed to create unique index on table %s: %w", bw.tableName, err)
+		}
+	}
+
+	bw.keyIndexReady = true
+	return nil
+}
+
+// ensureColumns creates the table, from the declared columns or else inferred from the records, and evolves the
+// inferred columns to fit the records (must be called with lock held)
+func (bw *BatchWriter) ensureColumns(records []models.Data) error {
+	if bw.config.HasSchema() {
+		return bw.ensureDeclaredTable()
+	}
+
+	inferred := InferColumnTypes(records)
+
+	if !bw.tableReady {
+		// the table may already exist, e.g. created before a restart or by another instance
+		existing, err := FindTableColumns(bw.tableName)
+		if err != nil {
+			return fmt.Errorf("failed to read columns of table %s: %w", bw.tableName, err)
+		}
+
+		if len(existing) == 0 {
+			if err = CreateTableFromMap(bw.tableName, inferred); err != nil {
+				return fmt.Errorf("failed to create table %s: %w", bw.tableName, err)
+			}
+
+			// re-read, the table may have been created concurrently with a different set of columns
+			if existing, err = FindTableColumns(bw.tableName); err != nil {
+				return fmt.Errorf("failed to read columns of table %s: %w", bw.tableName, err)
+			}
+		}
+
+		bw.columns = existing
+		bw.tableReady = true
+	}
+
+	// detect keys that have appeared since the table was created, and values that no longer fit their column
+	missing := make(map[string]ColumnType)
+	widened := make(map[string]ColumnType)
+	for key, columnType := range inferred {
+		current, exists := bw.columns[key]
+		switch {
+		case !exists:
+			missing[key] = columnType
+		case IsInferredColumnType(current):
+			if widest := WidenColumnType(current, columnType); widest != current {
+				widened[key] = widest
+			}
+		}
+	}
+
+	if err := AddColumns(bw.tableName, missing); err != nil {
+		return fmt.Errorf("failed to add columns to table %s: %w", bw.tableName, err)
+	}
+	for key, columnType := range missing {
+		bw.columns[key] = columnType
+	}
+
+	if err := AlterColumnTypes(bw.tableName, widened); err != nil {
+		return fmt.Errorf("failed to widen columns of table %s: %w", bw.tableName, err)
+	}
+	for key, columnType := range widened {
+		bw.columns[key] = columnType
+	}
 
 	return nil
 }
 
-// ensureTable creates the table if it doesn't exist using the schema from a sample record
-func (bw *BatchWriter) ensureTable(sample models.Data) error {
-	return CreateTableFromMap(bw.tableName, sample)
+// ensureDeclaredTable creates the table from the declared columns, adding any declared column missing from an
+// existing table. The declared types are used to bind values regardless of the types in the database (must be
+// called with lock held)
+func (bw *BatchWriter) ensureDeclaredTable() error {
+	if bw.tableReady {
+		return nil
+	}
+
+	definitions := bw.config.ColumnDefinitions()
+	for i := range definitions {
+		definitions[i].Name = bw.column(definitions[i].Name)
+	}
+
+	existing, err := FindTableColumns(bw.tableName)
+	if err != nil {
+		return fmt.Errorf("failed to read columns of table %s: %w", bw.tableName, err)
+	}
+
+	if len(existing) == 0 {
+		if err = CreateTableFromDefinition(bw.tableName, definitions); err != nil {
+			return fmt.Errorf("failed to create table %s: %w", bw.tableName, err)
+		}
+	} else {
+		var missing []ColumnDefinition
+		for _, definition := range definitions {
+			if _, exists := existing[definition.Name]; !exists {
+				missing = append(missing, definition)
+			}
+		}
+		if err = AddColumnDefinitions(bw.tableName, missing); err != nil {
+			return fmt.Errorf("failed to add columns to table %s: %w", bw.tableName, err)
+		}
+	}
+
+	bw.columns = make(map[string]ColumnType, len(definitions))
+	for _, definition := range definitions {
+		bw.columns[definition.Name] = definition.ColumnType()
+	}
+	bw.tableReady = true
+	return nil
 }
 
-// backgroundFlush runs a goroutine that periodically flushes the batch based on time
-func (bw *BatchWriter) backgroundFlush(interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+// backgroundFlush runs a goroutine that periodically flushes the batch based on time, and reports the messages held
+// by the batch in progress at the given interval such that they are not redelivered before the batch is flushed,
+// whether the batch window is disabled or longer than the ack wait
+func (bw *BatchWriter) backgroundFlush(progressInterval time.Duration) {
+	defer close(bw.flushDone)
+	defer bw.flushTicker.Stop()
+
+	progress := time.NewTicker(progressInterval)
+	defer progress.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
-			_ = bw.Flush()
+		case <-bw.flushTicker.C:
+			if err := bw.Flush(); err != nil {
+				log.Printf("error flushing table %s: %v\n", bw.Table(), err)
+			}
+		case <-progress.C:
+			bw.progressMessages()
 		case <-bw.stopFlush:
-			// Flush any remaining data before stopping
-			_ = bw.Flush()
 			return
 		}
 	}
 }
 
-// Stop gracefully shuts down the BatchWriter and its background goroutine
+// Stop gracefully shuts down the BatchWriter and its background goroutine. The writer is closed to further records
+// and the remaining batch is flushed before Stop returns, calling Stop again has no effect.
 func (bw *BatchWriter) Stop() {
-	close(bw.stopFlush)
+	bw.stopOnce.Do(func() {
+		close(bw.stopFlush)
+		<-bw.flushDone
+
+		bw.mu.Lock()
+		defer bw.mu.Unlock()
+		bw.closed = true
+		if err := bw.flush(); err != nil {
+			log.Printf("error flushing table %s on stop: %v\n", bw.tableName, err)
+		}
+
+		// spooled records loaded by the final flush stay in the spool for the next writer
+		bw.spool.rollback()
+		bw.reset()
+	})
+}
+
+// Acquire takes a lease on the writer, preventing its eviction until the lease is released
+func (bw *BatchWriter) Acquire() {
+	bw.refs.Add(1)
+}
+
+// Release releases a lease taken by Acquire or GetBatchWriter
+func (bw *BatchWriter) Release() {
+	bw.refs.Add(-1)
+}
+
+// Leased reports whether any lease is held on the writer
+func (bw *BatchWriter) Leased() bool {
+	return bw.refs.Load() > 0
 }
 
 // LastUsed returns when this writer was last used (for cleanup purposes)
 func (bw *BatchWriter) LastUsed() time.Time {
-	bw.mu.Lock()
-	defer bw.mu.Unlock()
-	return bw.lastUsed
+	return time.Unix(0, bw.lastUsed.Load())
 }
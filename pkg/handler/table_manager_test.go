@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quantumwake/alethic-ism-core-go/pkg/data/models"
+	"github.com/quantumwake/alethic-ism-core-go/pkg/repository/processor"
+	"gorm.io/gorm"
+)
+
+func TestSpillWithoutDirectoryRedeliversMessage(t *testing.T) {
+	dir := spillDir
+	spillDir = ""
+	t.Cleanup(func() { spillDir = dir })
+
+	config := testConfig(t)
+	policy, maxRecords := BackpressureSpill, int64(1)
+	config.Backpressure = &policy
+	config.MaxBufferedRecords = &maxRecords
+
+	writer, err := GetBatchWriter(config.ProcessorID, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Release()
+
+	if err = writer.Add(&testMessage{}, "route", []models.Data{{"id": float64(1)}}, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	// the buffer is full and there is nowhere to spill to, the message is left to the caller to redeliver
+	msg := &testMessage{}
+	if err = writer.Add(msg, "route", []models.Data{{"id": float64(2)}}, 16); !errors.Is(err, ErrBufferFull) {
+		t.Fatalf("Add on a full buffer without a spill directory returned %v, want ErrBufferFull", err)
+	}
+	if msg.acks.Load() != 0 {
+		t.Error("a message that was not spilled was acked")
+	}
+}
+
+func TestFlushReportsRowsWritten(t *testing.T) {
+	config := testConfig(t)
+	completedRoute, quarantinedRoute := config.ProcessorID+"/completed", config.ProcessorID+"/quarantined"
+
+	writer, err := GetBatchWriter(config.ProcessorID, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Release()
+
+	completed := []models.Data{{"id": float64(1)}, {"id": float64(2), "skip": true}, {"id": float64(3)}}
+	if err = writer.Add(&testMessage{}, completedRoute, completed, 48); err != nil {
+		t.Fatal(err)
+	}
+	quarantined := []models.Data{{"id": float64(4)}, {"id": float64(5), "skip": true}, {"id": float64(6), "refuse": true}}
+	if err = writer.Add(&testMessage{}, quarantinedRoute, quarantined, 48); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// records skipped on conflict or quarantined write no row
+	summaries := testMonitor.published(func(message models.MonitorMessage) bool {
+		summary, ok := message.Data.(FlushSummary)
+		return ok && summary.ProcessorID == config.ProcessorID
+	})
+	if len(summaries) != 1 {
+		t.Fatalf("published %d flush summaries, want 1", len(summaries))
+	}
+	if summary := summaries[0].Data.(FlushSummary); summary.Rows != 3 || summary.Quarantined != 1 {
+		t.Errorf("flush summary reports %d rows and %d quarantined, want 3 rows and 1 quarantined", summary.Rows, summary.Quarantined)
+	}
+
+	statuses := testMonitor.published(func(message models.MonitorMessage) bool {
+		return message.RouteID == completedRoute && message.Status == processor.Completed
+	})
+	if len(statuses) != 1 {
+		t.Fatalf("published %d completed statuses, want 1", len(statuses))
+	}
+	if summary := statuses[0].Data.(RouteFlushSummary); summary.Rows != 2 || summary.Records != 3 {
+		t.Errorf("route summary reports %d rows of %d records, want 2 rows of 3 records", summary.Rows, summary.Records)
+	}
+
+	failures := testMonitor.published(func(message models.MonitorMessage) bool {
+		return message.RouteID == quarantinedRoute && message.Status == processor.Failed
+	})
+	if len(failures) != 1 {
+		t.Fatalf("published %d failed statuses, want 1", len(failures))
+	}
+	if note := failures[0].Exception; !strings.Contains(note, "1 records quarantined") || !strings.Contains(note, "1 rows written") {
+		t.Errorf("quarantine note %q does not report 1 record quarantined and 1 row written", note)
+	}
+}
+
+func TestHeldMessagesAreReportedInProgress(t *testing.T) {
+	interval := ackProgressInterval
+	ackProgressInterval = 10 * time.Millisecond
+	t.Cleanup(func() { ackProgressInterval = interval })
+
+	// time based flushing is disabled, the message is held until the batch is flushed on demand
+	config := testConfig(t)
+	writer, err := GetBatchWriter(config.ProcessorID, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Release()
+
+	msg := &testMessage{}
+	if err = writer.Add(msg, "route", []models.Data{{"id": float64(1)}}, 16); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); msg.progress.Load() < 2; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("held message reported in progress %d times, want it reported on every tick", msg.progress.Load())
+		}
+	}
+
+	// an acked message is no longer reported
+	if err = writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reported := msg.progress.Load()
+	time.Sleep(50 * time.Millisecond)
+	if got := msg.progress.Load(); got != reported || msg.acks.Load() != 1 {
+		t.Errorf("message reported in progress %d times after it was acked %d times", got-reported, msg.acks.Load())
+	}
+}
+
+func TestInsertIsolatingQuarantinesRefusedRecords(t *testing.T) {
+	db := testDB(t)
+
+	records := []models.Data{{"id": float64(1)}, {"id": float64(2)}, {"id": float64(2)}, {"id": float64(3)}}
+	columns := InferColumnTypes(records)
+	table := testTable(t, columns)
+	if err := CreateUniqueIndex(table, []string{"id"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := DropTable(QuarantineTableName(table)); err != nil {
+			t.Errorf("failed to drop quarantine table: %v", err)
+		}
+	})
+
+	writer := &BatchWriter{config: testConfig(t), tableName: table, columns: columns}
+	batch := make([]batchRecord, len(records))
+	for i, record := range records {
+		batch[i] = batchRecord{routeID: "route", data: record, row: record}
+	}
+
+	// the duplicate of id 2 fails the batch and then its half, it is isolated while the other records are written
+	var result writeResult
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result = writeResult{rows: make(map[string]int64)}
+		if err := writer.insertIsolating(tx, batch, &result); err != nil {
+			return err
+		}
+		return writer.quarantine(tx, result.quarantined)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.written) != 3 || result.rows["route"] != 3 {
+		t.Errorf("wrote %d records affecting %d rows, want 3 records and 3 rows", len(result.written), result.rows["route"])
+	}
+	if len(result.quarantined) != 1 || result.quarantined[0].data["id"] != float64(2) {
+		t.Fatalf("quarantined %v, want the duplicate of id 2", result.quarantined)
+	}
+
+	for _, count := range []struct {
+		table string
+		want  int64
+	}{{table, 3}, {QuarantineTableName(table), 1}} {
+		var rows int64
+		if err = db.Table(count.table).Count(&rows).Error; err != nil {
+			t.Fatal(err)
+		}
+		if rows != count.want {
+			t.Errorf("table %s has %d rows, want %d", count.table, rows, count.want)
+		}
+	}
+}
+
+func TestBlockedAddGivesUpWhenIntakeCloses(t *testing.T) {
+	// flushes hang, such that the buffer stays full until the intake closes
+	write, unblock := writeBatch, make(chan struct{})
+	writeBatch = func(bw *BatchWriter) (writeResult, error) {
+		<-unblock
+		return write(bw)
+	}
+	t.Cleanup(func() { writeBatch = write })
+
+	config := testConfig(t)
+	t.Cleanup(func() { close(unblock) })
+	policy, maxRecords := BackpressureBlock, int64(1)
+	config.Backpressure = &policy
+	config.MaxBufferedRecords = &maxRecords
+
+	closing := make(chan struct{})
+	intakeMu.Lock()
+	done := intakeDone
+	intakeDone = closing
+	intakeMu.Unlock()
+	t.Cleanup(func() {
+		intakeMu.Lock()
+		intakeDone = done
+		intakeMu.Unlock()
+	})
+
+	writer, err := GetBatchWriter(config.ProcessorID, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Release()
+
+	if err = writer.Add(&testMessage{}, "route", []models.Data{{"id": float64(1)}}, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	added := make(chan error, 1)
+	go func() {
+		added <- writer.Add(&testMessage{}, "route", []models.Data{{"id": float64(2)}}, 16)
+	}()
+	select {
+	case err = <-added:
+		t.Fatalf("Add on a full buffer returned %v before the intake closed", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(closing)
+	select {
+	case err = <-added:
+		if !errors.Is(err, ErrShuttingDown) {
+			t.Errorf("blocked Add returned %v once the intake closed, want ErrShuttingDown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked Add did not give up once the intake closed")
+	}
+}